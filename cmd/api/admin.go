@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name    string
+		Email   string
+		filters data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.Email = app.readString(qs, "email", "")
+	input.filters.Page = app.readInt(qs, "page", 1, v)
+	input.filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.filters.Sort = app.readString(qs, "sort", "id")
+	input.filters.SortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+	if data.ValidateFields(v, input.filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Name, input.Email, input.filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	envelope := responseEnvelope{
+		"users":    users,
+		"metadata": metadata,
+	}
+	if err = app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam loads the user named by the ID URL parameter, writing the
+// error response when it can't.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	user, err := app.models.Users.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAll(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	envelope := responseEnvelope{
+		"user":        user,
+		"roles":       roles,
+		"permissions": permissions,
+	}
+	if err = app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) setUserActivatedHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Activated != nil, "activated", "must be provided")
+	if input.Activated != nil && !*input.Activated {
+		v.Check(user.ID != app.contextGetUser(r).ID, "activated", "you can't deactivate your own account")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Activated = *input.Activated
+	if err := app.models.Users.Update(user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidateUser(user.ID)
+	if !user.Activated {
+		if err := app.authenticator.revokeUser(user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if err := app.writeJSON(responseEnvelope{"user": user}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// forcePasswordResetHandler replaces the user's password with a random one,
+// ends their sessions and sends them a password reset token.
+func (app *application) forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := setRandomPassword(user); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.models.Users.Update(user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.authenticator.revokeUser(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.PlainText,
+		}
+		if err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	envelope := responseEnvelope{"message": "the user's password was reset and instructions were emailed to them"}
+	if err = app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	if int64(id) == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you can't delete your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// revoke first, stateless access tokens outlive the row.
+	if err = app.authenticator.revokeUser(int64(id)); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.models.Users.Delete(int64(id)); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidatePermissions(int64(id))
+	if err = app.writeJSON(responseEnvelope{"message": "user successfully deleted"}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	for _, code := range input.Permissions {
+		v.Check(validator.PermittdValue(code, known...), "permissions", "must only contain existing permissions")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = app.models.Permissions.AddForUser(user.ID, input.Permissions...); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.authCache.invalidatePermissions(user.ID)
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	code := chi.URLParam(r, "code")
+	if user.ID == app.contextGetUser(r).ID && data.Permissions([]string{code}).Includes(data.PermissionUsersAdmin) {
+		v := validator.New()
+		v.AddError("code", "you can't revoke your own "+data.PermissionUsersAdmin+" permission")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.models.Permissions.RemoveForUser(user.ID, code); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.authCache.invalidatePermissions(user.ID)
+	if err := app.authenticator.revokeAccessTokens(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"permissions": permissions}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setRandomPassword gives the user a password nobody knows, for accounts that
+// must only be reachable through a reset or another way of logging in.
+func setRandomPassword(user *data.User) error {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return err
+	}
+	return user.Password.Set(base64.RawStdEncoding.EncodeToString(randBytes))
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/jwt"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+var errInvalidToken = errors.New("invalid authentication token")
+
+// authSession is what an access token says about the request beyond the user.
+type authSession struct {
+	token  string
+	family string
+	// permissions, when scoped is set, are the ones carried by the token and
+	// replace a lookup in the permissions table.
+	permissions data.Permissions
+	scoped      bool
+	// apiKey is set when the request was authenticated with an API key, whose
+	// permissions narrow down the owner's.
+	apiKey *data.APIKey
+}
+
+// authenticator issues and checks access tokens. Refresh tokens and session
+// families always live in the tokens table, whatever the mode.
+type authenticator interface {
+	// issue returns a new access token for user, bound to a session family.
+	// ip and userAgent describe the client it is issued to.
+	issue(user *data.User, family, ip, userAgent string) (*data.Token, error)
+	// authenticate resolves an access token, or fails with errInvalidToken.
+	authenticate(token string) (*data.User, *authSession, error)
+	// revokeSession ends one session of the user. token is the access token
+	// being used, when known.
+	revokeSession(userID int64, family, token string) error
+	// revokeUser ends every session of the user.
+	revokeUser(userID int64) error
+	// revokeOtherSessions ends every session of the user but keep.
+	revokeOtherSessions(userID int64, keep string) error
+	// revokeAccessTokens is called once the user's permissions shrank. It
+	// keeps the user's sessions, refreshing them issues tokens with the
+	// current permissions.
+	revokeAccessTokens(userID int64) error
+}
+
+func (app *application) newAuthenticator() (authenticator, error) {
+	switch app.config.auth.mode {
+	case "stateful":
+		return &statefulAuthenticator{models: app.models, ttl: app.config.auth.accessTTL, cache: app.authCache}, nil
+
+	case "stateless":
+		keys, err := jwt.ParseKeys(app.config.auth.signingKeys)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := jwt.NewKeys(app.config.auth.signingKeyID, keys)
+		if err != nil {
+			return nil, err
+		}
+		a := &statelessAuthenticator{models: app.models, keys: signer, ttl: app.config.auth.accessTTL}
+		if app.config.auth.denylist {
+			a.denylist, err = app.newDenylist()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+
+	default:
+		return nil, fmt.Errorf("unknown authentication mode %q", app.config.auth.mode)
+	}
+}
+
+// authenticateAPIKey resolves an API key sent by a machine client. Keys are
+// long lived and stored hashed, so they don't go through the authenticator.
+func (app *application) authenticateAPIKey(plainText, ip string) (*data.User, *authSession, error) {
+	if !data.LooksLikeAPIKey(plainText) {
+		return nil, nil, errInvalidToken
+	}
+	key, user, err := app.models.APIKeys.GetForKey(plainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil, errInvalidToken
+		default:
+			return nil, nil, err
+		}
+	}
+	if key.Expired() || !key.AllowsIP(ip) {
+		return nil, nil, errInvalidToken
+	}
+	return user, &authSession{apiKey: key}, nil
+}
+
+// statefulAuthenticator keeps access tokens in the tokens table and looks
+// every one of them up.
+type statefulAuthenticator struct {
+	models data.Models
+	ttl    time.Duration
+	cache  *authCache
+}
+
+func (a *statefulAuthenticator) issue(user *data.User, family, ip, userAgent string) (*data.Token, error) {
+	return a.models.Tokens.NewForClient(user.ID, a.ttl, data.ScopeAuthenticaton, family, ip, userAgent)
+}
+
+func (a *statefulAuthenticator) authenticate(token string) (*data.User, *authSession, error) {
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, token); !v.Valid() {
+		return nil, nil, errInvalidToken
+	}
+	if user, family, found := a.cache.token(token); found {
+		return user, &authSession{token: token, family: family}, nil
+	}
+
+	generation := a.cache.tokenGeneration()
+	user, err := a.models.Users.GetForToken(data.ScopeAuthenticaton, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil, errInvalidToken
+		default:
+			return nil, nil, err
+		}
+	}
+	family, expiry, err := a.models.Tokens.Touch(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.cache.setToken(token, user, family, expiry, generation)
+	return user, &authSession{token: token, family: family}, nil
+}
+
+// The revoke methods invalidate the cache once the tokens are deleted, so a
+// lookup racing them can't cache a token again.
+func (a *statefulAuthenticator) revokeSession(userID int64, family, token string) error {
+	defer a.cache.invalidateUser(userID)
+	if family == "" {
+		err := a.models.Tokens.DeleteByPlainText(data.ScopeAuthenticaton, token)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return a.models.Tokens.DeleteFamily(userID, family)
+}
+
+func (a *statefulAuthenticator) revokeUser(userID int64) error {
+	defer a.cache.invalidateUser(userID)
+	for _, scope := range []string{data.ScopeAuthenticaton, data.ScopeRefresh} {
+		if err := a.models.Tokens.DeleteAllForUser(scope, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *statefulAuthenticator) revokeOtherSessions(userID int64, keep string) error {
+	defer a.cache.invalidateUser(userID)
+	_, err := a.models.Tokens.DeleteOtherFamilies(userID, keep)
+	return err
+}
+
+// revokeAccessTokens does nothing, permissions are looked up on every
+// request rather than carried by the token.
+func (a *statefulAuthenticator) revokeAccessTokens(userID int64) error {
+	return nil
+}
+
+// statelessAuthenticator issues signed tokens that are verified without
+// touching the database. The user it returns only has ID and Activated set,
+// handlers needing more must load the user. Without a denylist, revoked
+// access tokens stay valid until they expire.
+type statelessAuthenticator struct {
+	models   data.Models
+	keys     *jwt.Keys
+	ttl      time.Duration
+	denylist *denylist
+}
+
+func (a *statelessAuthenticator) issue(user *data.User, family, _, _ string) (*data.Token, error) {
+	permissions, err := a.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	randBytes := make([]byte, 16)
+	if _, err = rand.Read(randBytes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		ID:        base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes),
+		Subject:   user.ID,
+		Session:   family,
+		Scopes:    permissions,
+		Activated: user.Activated,
+		IssuedAt:  float64(now.UnixMicro()) / 1e6,
+		Expiry:    now.Add(a.ttl).Unix(),
+	}
+	signed, err := a.keys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{
+		PlainText: signed,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthenticaton,
+		Family:    family,
+	}, nil
+}
+
+func (a *statelessAuthenticator) authenticate(token string) (*data.User, *authSession, error) {
+	claims, err := a.keys.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, errInvalidToken
+	}
+	if a.denylist != nil && a.denylist.denies(claims) {
+		return nil, nil, errInvalidToken
+	}
+	if claims.Scopes == nil {
+		claims.Scopes = []string{}
+	}
+
+	user := &data.User{ID: claims.Subject, Activated: claims.Activated}
+	session := &authSession{
+		token:       token,
+		family:      claims.Session,
+		permissions: claims.Scopes,
+		scoped:      true,
+	}
+	return user, session, nil
+}
+
+func (a *statelessAuthenticator) revokeSession(userID int64, family, token string) error {
+	if family != "" {
+		if err := a.models.Tokens.DeleteFamily(userID, family); err != nil {
+			return err
+		}
+	}
+	if a.denylist == nil {
+		return nil
+	}
+	if family != "" {
+		return a.denylist.add("sid:"+family, time.Now().Add(a.ttl))
+	}
+	claims, err := a.keys.Verify(token, time.Now())
+	if err != nil {
+		return nil
+	}
+	return a.denylist.add("jti:"+claims.ID, time.Unix(claims.Expiry, 0))
+}
+
+func (a *statelessAuthenticator) revokeUser(userID int64) error {
+	if err := a.models.Tokens.DeleteAllForUser(data.ScopeRefresh, userID); err != nil {
+		return err
+	}
+	if a.denylist == nil {
+		return nil
+	}
+	return a.denylist.add("user:"+strconv.FormatInt(userID, 10), time.Now().Add(a.ttl))
+}
+
+func (a *statelessAuthenticator) revokeOtherSessions(userID int64, keep string) error {
+	families, err := a.models.Tokens.DeleteOtherFamilies(userID, keep)
+	if err != nil || a.denylist == nil {
+		return err
+	}
+	for _, family := range families {
+		if err = a.denylist.add("sid:"+family, time.Now().Add(a.ttl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeAccessTokens denies every access token issued to the user so far,
+// they carry the permissions the user held then.
+func (a *statelessAuthenticator) revokeAccessTokens(userID int64) error {
+	if a.denylist == nil {
+		return nil
+	}
+	return a.denylist.add("user:"+strconv.FormatInt(userID, 10), time.Now().Add(a.ttl))
+}
+
+// denylist is an in-memory copy of the token_denylist table, reloaded
+// periodically so revocations made by other instances are picked up.
+type denylist struct {
+	mu      sync.RWMutex
+	model   data.DenylistModel
+	entries map[string]time.Time
+}
+
+// newDenylist loads the denylist and reloads it every auth.denylistRefresh
+// until the server shuts down.
+func (app *application) newDenylist() (*denylist, error) {
+	d := &denylist{model: app.models.Denylist}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	app.background(func() {
+		ticker := time.NewTicker(app.config.auth.denylistRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+			}
+			if err := d.reload(); err != nil {
+				app.logger.PrintError(err, map[string]string{"component": "denylist"})
+			}
+		}
+	})
+	return d, nil
+}
+
+func (d *denylist) reload() error {
+	entries, err := d.model.GetActive()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.entries = entries
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *denylist) add(key string, expiry time.Time) error {
+	revokedAt, err := d.model.Add(key, expiry)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.entries[key] = revokedAt
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *denylist) denies(claims *jwt.Claims) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, found := d.entries["jti:"+claims.ID]; found {
+		return true
+	}
+	if _, found := d.entries["sid:"+claims.Session]; found && claims.Session != "" {
+		return true
+	}
+	revokedAt, found := d.entries["user:"+strconv.FormatInt(claims.Subject, 10)]
+	return found && claims.IssuedAt <= float64(revokedAt.UnixMicro())/1e6
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+)
+
+// lruCache is a size bounded cache whose entries expire after ttl. When full,
+// the least recently used entry is evicted.
+//
+// Every removal bumps the cache's generation. A value read from the database
+// is stored with the generation taken before the read, and dropped if it
+// changed since: a removal racing the read may have missed it.
+type lruCache[K comparable, V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	size       int
+	order      *list.List
+	entries    map[K]*list.Element
+	generation uint64
+	hits       *expvar.Int
+	misses     *expvar.Int
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[K comparable, V any](ttl time.Duration, size int, hits, misses *expvar.Int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+		hits:    hits,
+		misses:  misses,
+	}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found := c.entries[key]; found {
+		entry := element.Value.(*lruEntry[K, V])
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.hits.Add(1)
+			return entry.value, true
+		}
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.misses.Add(1)
+	var zero V
+	return zero, false
+}
+
+// currentGeneration is to be taken before reading a value to set.
+func (c *lruCache[K, V]) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// set stores the value, read at the given generation, until ttl passes or
+// notAfter if it comes first. A zero notAfter is ignored.
+func (c *lruCache[K, V]) set(key K, value V, generation uint64, notAfter time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// removeIf drops every entry for which match returns true.
+func (c *lruCache[K, V]) removeIf(match func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, element := range c.entries {
+		if match(key, element.Value.(*lruEntry[K, V]).value) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// authCache spares the database the token and permission lookups made on
+// every authenticated request. A nil *authCache caches nothing.
+type authCache struct {
+	tokens      *lruCache[[sha256.Size]byte, cachedToken]
+	permissions *lruCache[int64, data.Permissions]
+}
+
+type cachedToken struct {
+	user   data.User
+	family string
+}
+
+func newAuthCache(ttl time.Duration, size int) *authCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	metrics := expvar.NewMap("auth_cache")
+	counter := func(name string) *expvar.Int {
+		v := new(expvar.Int)
+		metrics.Set(name, v)
+		return v
+	}
+	return &authCache{
+		tokens:      newLRUCache[[sha256.Size]byte, cachedToken](ttl, size, counter("token_hits"), counter("token_misses")),
+		permissions: newLRUCache[int64, data.Permissions](ttl, size, counter("permission_hits"), counter("permission_misses")),
+	}
+}
+
+// token returns a copy of the user the access token belongs to, and the
+// token's family.
+func (c *authCache) token(plainText string) (*data.User, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+	cached, found := c.tokens.get(sha256.Sum256([]byte(plainText)))
+	if !found {
+		return nil, "", false
+	}
+	user := cached.user
+	return &user, cached.family, true
+}
+
+// tokenGeneration is to be taken before looking up the token passed to
+// setToken.
+func (c *authCache) tokenGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.tokens.currentGeneration()
+}
+
+// setToken caches the token's user and family, no longer than the token
+// itself is valid.
+func (c *authCache) setToken(plainText string, user *data.User, family string, expiry time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.tokens.set(sha256.Sum256([]byte(plainText)), cachedToken{user: *user, family: family}, generation, expiry)
+}
+
+func (c *authCache) userPermissions(userID int64) (data.Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.permissions.get(userID)
+}
+
+// permissionsGeneration is to be taken before looking up the permissions
+// passed to setUserPermissions.
+func (c *authCache) permissionsGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.permissions.currentGeneration()
+}
+
+func (c *authCache) setUserPermissions(userID int64, permissions data.Permissions, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.permissions.set(userID, permissions, generation, time.Time{})
+}
+
+// invalidateUser forgets the tokens of the user, to be called once the user
+// or their tokens changed in the database.
+func (c *authCache) invalidateUser(userID int64) {
+	if c == nil {
+		return
+	}
+	c.tokens.removeIf(func(_ [sha256.Size]byte, cached cachedToken) bool {
+		return cached.user.ID == userID
+	})
+}
+
+func (c *authCache) invalidatePermissions(userID int64) {
+	if c == nil {
+		return
+	}
+	c.permissions.removeIf(func(id int64, _ data.Permissions) bool {
+		return id == userID
+	})
+}
+
+// invalidateAllPermissions is for changes, like a role update, that may
+// affect any user.
+func (c *authCache) invalidateAllPermissions() {
+	if c == nil {
+		return
+	}
+	c.permissions.removeIf(func(int64, data.Permissions) bool {
+		return true
+	})
+}
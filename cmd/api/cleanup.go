@@ -0,0 +1,149 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+)
+
+// cleanupMetrics count what the cleanup worker removed since startup.
+var cleanupMetrics = expvar.NewMap("cleanup")
+
+// startCleanupWorker runs the cleanup every cleanup.interval, under the
+// background wait group so shutdown waits for a run in progress.
+func (app *application) startCleanupWorker() {
+	if app.config.cleanup.interval <= 0 {
+		return
+	}
+	app.background(func() {
+		ticker := time.NewTicker(app.config.cleanup.interval)
+		defer ticker.Stop()
+		for {
+			app.runCleanup()
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// runCleanup purges expired tokens, denylist entries and OIDC logins, warns users who never
+// activated their account that it will be deleted and deletes those warned
+// long enough ago.
+func (app *application) runCleanup() {
+	start := time.Now()
+	tokens, err := app.deleteInBatches(app.models.Tokens.DeleteExpired)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"component": "cleanup"})
+	}
+	denied, err := app.deleteInBatches(app.models.Denylist.DeleteExpired)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"component": "cleanup"})
+	}
+	states, err := app.models.Identities.DeleteExpiredStates()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"component": "cleanup"})
+	}
+
+	var warned, deleted int64
+	if after := app.config.cleanup.unactivatedAfter; after > 0 {
+		warning := app.config.cleanup.warningPeriod
+		warned, err = app.warnStaleUsers(start.Add(-(after - warning)), start.Add(warning))
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"component": "cleanup"})
+		}
+		deleted, err = app.deleteInBatches(func(limit int) (int64, error) {
+			return app.models.Users.DeleteStale(start.Add(-after), start.Add(-warning), limit)
+		})
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"component": "cleanup"})
+		}
+	}
+
+	cleanupMetrics.Add("runs", 1)
+	cleanupMetrics.Add("tokens_deleted", tokens)
+	cleanupMetrics.Add("denylist_entries_deleted", denied)
+	cleanupMetrics.Add("oidc_states_deleted", states)
+	cleanupMetrics.Add("accounts_warned", warned)
+	cleanupMetrics.Add("accounts_deleted", deleted)
+	app.logger.PrintInfo("cleanup finished", map[string]string{
+		"tokens_deleted":           strconv.FormatInt(tokens, 10),
+		"denylist_entries_deleted": strconv.FormatInt(denied, 10),
+		"oidc_states_deleted":      strconv.FormatInt(states, 10),
+		"accounts_warned":          strconv.FormatInt(warned, 10),
+		"accounts_deleted":         strconv.FormatInt(deleted, 10),
+		"duration":                 time.Since(start).String(),
+	})
+}
+
+// deleteInBatches calls deleteBatch until it deletes less than a full batch
+// or the server shuts down, and returns the total deleted.
+func (app *application) deleteInBatches(deleteBatch func(limit int) (int64, error)) (int64, error) {
+	var total int64
+	for {
+		n, err := deleteBatch(app.config.cleanup.batchSize)
+		total += n
+		if err != nil || n < int64(app.config.cleanup.batchSize) {
+			return total, err
+		}
+		select {
+		case <-app.shutdown:
+			return total, nil
+		default:
+		}
+	}
+}
+
+// warnStaleUsers emails the users who registered before registeredBefore and
+// never activated their account a new activation token, valid until the
+// account is deleted at deletionDate. A user who can't be warned is skipped
+// until the next run.
+func (app *application) warnStaleUsers(registeredBefore, deletionDate time.Time) (int64, error) {
+	var warned, afterID int64
+	for {
+		users, err := app.models.Users.GetUnwarnedStale(registeredBefore, afterID, app.config.cleanup.batchSize)
+		if err != nil {
+			return warned, err
+		}
+		for _, user := range users {
+			afterID = user.ID
+			if err = app.warnStaleUser(user, deletionDate); err != nil {
+				app.logger.PrintError(err, map[string]string{"component": "cleanup", "user_id": strconv.FormatInt(user.ID, 10)})
+				continue
+			}
+			warned++
+		}
+		if len(users) < app.config.cleanup.batchSize {
+			return warned, nil
+		}
+		select {
+		case <-app.shutdown:
+			return warned, nil
+		default:
+		}
+	}
+}
+
+func (app *application) warnStaleUser(user *data.User, deletionDate time.Time) error {
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID); err != nil {
+		return err
+	}
+	token, err := app.models.Tokens.New(user.ID, time.Until(deletionDate), data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+	data := map[string]any{
+		"activationToken": token.PlainText,
+		"deletionDate":    deletionDate.Format("January 2, 2006"),
+	}
+	// marked only once sent, so nobody is deleted without being told, at
+	// the risk of a second email if marking fails.
+	if err = app.mailer.Send(user.Email, "account_deletion_warning.tmpl", data); err != nil {
+		return err
+	}
+	return app.models.Users.MarkDeletionWarned(user.ID)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/v3ronez/IDKN/internal/data"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("192.0.2.1, 198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"no headers", "203.0.113.9:4000", nil, "203.0.113.9"},
+		{"X-Real-Ip from a client", "203.0.113.9:4000", map[string]string{"X-Real-Ip": "10.0.0.1"}, "203.0.113.9"},
+		{"X-Forwarded-For from a client", "203.0.113.9:4000", map[string]string{"X-Forwarded-For": "10.0.0.1"}, "203.0.113.9"},
+		{"X-Real-Ip from a proxy", "192.0.2.1:4000", map[string]string{"X-Real-Ip": "203.0.113.9"}, "203.0.113.9"},
+		{"X-Forwarded-For from a proxy", "192.0.2.1:4000", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		// the client sent the first hop, only the ones the proxies added count.
+		{"spoofed first hop", "192.0.2.1:4000", map[string]string{"X-Forwarded-For": "10.0.0.1, 203.0.113.9, 198.51.100.7"}, "203.0.113.9"},
+		{"malformed hop", "192.0.2.1:4000", map[string]string{"X-Forwarded-For": "10.0.0.1, nonsense, 198.51.100.7"}, "198.51.100.7"},
+		{"only proxies", "192.0.2.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"IPv6 peer", "[2001:db8::1]:4000", map[string]string{"X-Real-Ip": "10.0.0.1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := clientIP(r, proxies); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeySpoofedIP(t *testing.T) {
+	key := &data.APIKey{IPAllowlist: []string{"10.0.0.0/8"}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.9:4000"
+	r.Header.Set("X-Real-Ip", "10.0.0.1")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	if key.AllowsIP(clientIP(r, nil)) {
+		t.Error("key used from a disallowed address claiming an allowed one")
+	}
+
+	r.RemoteAddr = "10.0.0.1:4000"
+	if !key.AllowsIP(clientIP(r, nil)) {
+		t.Error("key refused from an allowed address")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("")
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("empty list: got %v, %v", proxies, err)
+	}
+	for _, list := range []string{"proxy.internal", "10.0.0.0/33", "10.0.0.1, 300.0.0.1"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("accepted %q", list)
+		}
+	}
+}
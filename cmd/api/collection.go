@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+func (app *application) createCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		MovieIDs    []int64 `json:"movie_ids"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	collection := &data.Collection{
+		Name:        input.Name,
+		Description: input.Description,
+		MovieIDs:    input.MovieIDs,
+	}
+	if collection.MovieIDs == nil {
+		collection.MovieIDs = []int64{}
+	}
+
+	v := validator.New()
+	if data.ValidateCollection(v, collection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Collections.Insert(collection); err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCollectionMovie):
+			v.AddError("movie_ids", "must only reference existing movies")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/collections/%d", collection.ID))
+	if err := app.writeJSON(responseEnvelope{"collection": collection}, w, http.StatusCreated, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name    string
+		filters data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.filters.Page = app.readInt(qs, "page", 1, v)
+	input.filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.filters.Sort = app.readString(qs, "sort", "id")
+	input.filters.SortSafeList = []string{"id", "name", "-id", "-name"}
+
+	if data.ValidateFields(v, input.filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	collections, metadata, err := app.models.Collections.GetAll(input.Name, input.filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	envelope := responseEnvelope{
+		"collections": collections,
+		"metadata":    metadata,
+	}
+	if err := app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	collection, err := app.models.Collections.Get(int64(collectionID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.writeJSON(responseEnvelope{"collection": collection}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCollectionMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	collection, err := app.models.Collections.Get(int64(collectionID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	canEdit, err := app.hasAnyPermission(r, data.PermissionMovieCreate, data.PermissionMoviePublish)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movies, err := app.models.Collections.GetMovies(collection.ID, canEdit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	envelope := responseEnvelope{
+		"collection": collection,
+		"movies":     movies,
+	}
+	if err := app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	collection, err := app.models.Collections.Get(int64(collectionID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		MovieIDs    []int64 `json:"movie_ids"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		collection.Name = *input.Name
+	}
+	if input.Description != nil {
+		collection.Description = *input.Description
+	}
+	if input.MovieIDs != nil {
+		collection.MovieIDs = input.MovieIDs
+	}
+
+	v := validator.New()
+	if data.ValidateCollection(v, collection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = app.models.Collections.Update(collection); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrInvalidCollectionMovie):
+			v.AddError("movie_ids", "must only reference existing movies")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.writeJSON(responseEnvelope{"collection": collection}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	if err = app.models.Collections.Delete(int64(collectionID)); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.writeJSON(responseEnvelope{"collection": "deleted successfully"}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -9,7 +9,10 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey    = contextKey("user")
+	sessionContextKey = contextKey("session")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +26,18 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetSession(r *http.Request, session *authSession) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns the session the request was authenticated with,
+// or an empty one for anonymous requests.
+func (app *application) contextGetSession(r *http.Request) *authSession {
+	session, ok := r.Context().Value(sessionContextKey).(*authSession)
+	if !ok {
+		return &authSession{}
+	}
+	return session
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -28,6 +31,17 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	}
 }
 
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	headers := http.Header{}
+	headers.Set("Retry-After", strconv.Itoa(seconds))
+	message := fmt.Sprintf("too many failed login attempts, try again in %d seconds", seconds)
+	if err := app.writeJSON(responseEnvelope{"error": message}, w, http.StatusTooManyRequests, headers); err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+}
+
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
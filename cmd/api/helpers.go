@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/v3ronez/IDKN/internal/filter"
 	"github.com/v3ronez/IDKN/internal/validator"
 )
 
@@ -39,6 +40,23 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// readFilter parses and checks the filter expression in key against fields.
+// It returns a nil node when the parameter is absent.
+func (app *application) readFilter(qs url.Values, key string, fields filter.Fields) (filter.Node, error) {
+	s := qs.Get(key)
+	if s == "" {
+		return nil, nil
+	}
+	node, err := filter.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if err = filter.Check(node, fields); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
 func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
 	s := qs.Get(key)
 	if s == "" {
@@ -131,14 +149,27 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
+func (app *application) invalidFilterResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var syntaxError *filter.SyntaxError
+	if !errors.As(err, &syntaxError) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	message := map[string]any{
+		"filter":   syntaxError.Msg,
+		"position": syntaxError.Pos,
+	}
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
-	message := "invalid credentials"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	message := "invalid email, password or code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +191,16 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) invalidStatusTransitionResponse(w http.ResponseWriter, r *http.Request, from, to string) {
+	message := fmt.Sprintf("a movie can't move from %s to %s", from, to)
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) twoFactorEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 	go func() {
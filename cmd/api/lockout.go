@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+)
+
+// Failed logins are counted per email address and per client IP. Past
+// backoffAfter failures each attempt has to wait twice as long as the previous
+// one, and reaching a threshold locks the key for a while.
+//
+// An attempt is counted as a failure before the password is compared, and
+// taken back if it matches, so parallel guesses are throttled like
+// sequential ones.
+
+func loginKeys(email, ip string) (emailKey, ipKey string) {
+	return "email:" + strings.ToLower(email), "ip:" + ip
+}
+
+// loginAttempt is a login attempt reserveLogin counted against the email and
+// the IP it was made from.
+type loginAttempt struct {
+	emailKey      string
+	ipKey         string
+	ip            string
+	emailFailures int
+	ipFailures    int
+}
+
+// reserveLogin counts a login attempt for email from ip. When either of them
+// is throttled it returns no attempt and how long the client has to wait.
+func (app *application) reserveLogin(email, ip string) (*loginAttempt, time.Duration, error) {
+	cfg := app.config.login
+	backoff := data.LoginBackoff{After: cfg.backoffAfter, Base: cfg.backoffBase, Max: cfg.lockoutDuration}
+	attempt := &loginAttempt{ip: ip}
+	attempt.emailKey, attempt.ipKey = loginKeys(email, ip)
+
+	var err error
+	attempt.emailFailures, err = app.models.Logins.Reserve(attempt.emailKey, cfg.window, backoff)
+	if err == nil {
+		attempt.ipFailures, err = app.models.Logins.Reserve(attempt.ipKey, cfg.window, backoff)
+		if errors.Is(err, data.ErrLoginThrottled) {
+			if err := app.models.Logins.Release(attempt.emailKey); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, data.ErrLoginThrottled):
+		retryAfter, err := app.loginRetryAfter(attempt.emailKey, attempt.ipKey)
+		if err != nil {
+			return nil, 0, err
+		}
+		// the wait may have ended in between, the client can retry at once.
+		return nil, max(retryAfter, time.Second), nil
+	case err != nil:
+		return nil, 0, err
+	}
+	return attempt, 0, nil
+}
+
+// loginRetryAfter returns how long the client has to wait before it may try
+// to log in again, zero if it may try now.
+func (app *application) loginRetryAfter(keys ...string) (time.Duration, error) {
+	failures, err := app.models.Logins.Get(keys...)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, lf := range failures {
+		if lf.LockedUntil != nil && lf.LockedUntil.Sub(now) > wait {
+			wait = lf.LockedUntil.Sub(now)
+		}
+		if backoff := app.loginBackoff(lf.Failures) - now.Sub(lf.LastFailureAt); backoff > wait {
+			wait = backoff
+		}
+	}
+	return wait, nil
+}
+
+func (app *application) loginBackoff(failures int) time.Duration {
+	cfg := app.config.login
+	if failures < cfg.backoffAfter {
+		return 0
+	}
+	backoff := cfg.backoffBase
+	for i := cfg.backoffAfter; i < failures && backoff < cfg.lockoutDuration; i++ {
+		backoff *= 2
+	}
+	return min(backoff, cfg.lockoutDuration)
+}
+
+// loginSucceeded forgets the failures of the email and takes the attempt
+// back from the IP.
+func (app *application) loginSucceeded(attempt *loginAttempt) error {
+	if err := app.models.Logins.Reset(attempt.emailKey); err != nil {
+		return err
+	}
+	return app.models.Logins.Release(attempt.ipKey)
+}
+
+// loginFailed locks the email or the IP of a failed attempt once they reach
+// their threshold. user is nil when no account matches the email.
+func (app *application) loginFailed(attempt *loginAttempt, user *data.User) error {
+	cfg := app.config.login
+	if attempt.emailFailures >= cfg.lockoutThreshold {
+		if err := app.models.Logins.Lock(attempt.emailKey, time.Now().Add(cfg.lockoutDuration)); err != nil {
+			return err
+		}
+		app.logger.PrintInfo("login locked", map[string]string{"key": attempt.emailKey, "ip": attempt.ip})
+		if user != nil {
+			app.background(func() {
+				data := map[string]any{
+					"ip":        attempt.ip,
+					"lockedFor": cfg.lockoutDuration.String(),
+				}
+				if err := app.mailer.Send(user.Email, "login_locked.tmpl", data); err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+
+	if attempt.ipFailures >= cfg.ipLockoutThreshold {
+		if err := app.models.Logins.Lock(attempt.ipKey, time.Now().Add(cfg.lockoutDuration)); err != nil {
+			return err
+		}
+		app.logger.PrintInfo("login locked", map[string]string{"key": attempt.ipKey})
+	}
+	return nil
+}
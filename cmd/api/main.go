@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"runtime"
 	"strconv"
@@ -19,6 +20,9 @@ import (
 	"github.com/v3ronez/IDKN/internal/data"
 	"github.com/v3ronez/IDKN/internal/jsonlog"
 	"github.com/v3ronez/IDKN/internal/mailer"
+	"github.com/v3ronez/IDKN/internal/oidc"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
 )
 
 const version = "1.0"
@@ -36,15 +40,89 @@ type dbConfig struct {
 }
 
 type config struct {
-	servPort int
-	envMode  string
-	db       dbConfig
-	smtp     struct {
+	servPort       int
+	envMode        string
+	trustedProxies string
+	db             dbConfig
+	smtp           struct {
 		host     string
 		port     int
 		username string
 		password string
 	}
+	stats struct {
+		cacheTTL time.Duration
+	}
+	suggest struct {
+		limit   int
+		timeout time.Duration
+		rps     float64
+		burst   int
+	}
+	activation struct {
+		resendInterval time.Duration
+		resendBurst    int
+	}
+	passwordReset struct {
+		resendInterval time.Duration
+		resendBurst    int
+	}
+	auth struct {
+		mode            string
+		accessTTL       time.Duration
+		refreshTTL      time.Duration
+		signingKeys     string
+		signingKeyID    string
+		denylist        bool
+		denylistRefresh time.Duration
+		cacheTTL        time.Duration
+		cacheSize       int
+	}
+	permissions struct {
+		sync bool
+	}
+	registration struct {
+		concealExisting bool
+		defaultRole     string
+	}
+	login struct {
+		backoffAfter       int
+		backoffBase        time.Duration
+		lockoutThreshold   int
+		ipLockoutThreshold int
+		lockoutDuration    time.Duration
+		window             time.Duration
+	}
+	twoFactor struct {
+		issuer          string
+		skew            int
+		loginTTL        time.Duration
+		attemptInterval time.Duration
+		attemptBurst    int
+		maxAttempts     int
+	}
+	passwords struct {
+		hasher            string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		minLength         int
+		minScore          int
+		rejectPersonal    bool
+		breachedCheck     bool
+		breachedDir       string
+	}
+	cleanup struct {
+		interval         time.Duration
+		batchSize        int
+		unactivatedAfter time.Duration
+		warningPeriod    time.Duration
+	}
+	oidc struct {
+		providersFile string
+		stateTTL      time.Duration
+	}
 }
 type application struct {
 	config  config
@@ -55,8 +133,17 @@ type application struct {
 		burst   int
 		enabled bool
 	}
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	mailer            mailer.Mailer
+	wg                sync.WaitGroup
+	statsCache        statsCache
+	activationLimiter *keyedLimiter
+	resetLimiter      *keyedLimiter
+	twoFactorLimiter  *keyedLimiter
+	authenticator     authenticator
+	authCache         *authCache
+	oidcProviders     map[string]*oidc.Provider
+	trustedProxies    []*net.IPNet
+	shutdown          chan struct{}
 }
 
 func main() {
@@ -67,9 +154,57 @@ func main() {
 	config := &config{}
 	flag.IntVar(&config.servPort, "port", 8000, "API server port")
 	flag.StringVar(&config.envMode, "env", "dev", "Environment (dev|staging|production)")
+	flag.StringVar(&config.trustedProxies, "trusted-proxies", "", "comma separated IP addresses and CIDR ranges of the proxies whose X-Forwarded-For and X-Real-Ip headers are trusted")
 	flag.IntVar(&config.db.maxOpenConns, "db-max-open-conns", 25, "set default value to db max open conns")
 	flag.IntVar(&config.db.maxIdleConns, "db-max-idle-conns", 25, "set default value to db max idle conns")
 	flag.StringVar(&config.db.maxIndleTime, "db-max-idle-time", "15m", "set default value db to idle time conn")
+	flag.IntVar(&config.suggest.limit, "suggest-limit", 10, "maximum number of title suggestions returned")
+	flag.DurationVar(&config.suggest.timeout, "suggest-timeout", 300*time.Millisecond, "query timeout for title suggestions")
+	flag.Float64Var(&config.suggest.rps, "suggest-limiter-rps", 10, "title suggestions rate limiter maximum requests per second")
+	flag.IntVar(&config.suggest.burst, "suggest-limiter-burst", 20, "title suggestions rate limiter maximum burst")
+	flag.StringVar(&config.auth.mode, "auth-mode", "stateful", "Authentication token mode (stateful|stateless)")
+	flag.BoolVar(&config.auth.denylist, "auth-denylist", true, "check stateless tokens against the revocation denylist")
+	flag.DurationVar(&config.auth.denylistRefresh, "auth-denylist-refresh", 30*time.Second, "how often the revocation denylist is reloaded from the database")
+	flag.DurationVar(&config.auth.accessTTL, "auth-access-token-ttl", 15*time.Minute, "lifetime of authentication (access) tokens")
+	flag.DurationVar(&config.auth.refreshTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "lifetime of refresh tokens")
+	flag.DurationVar(&config.auth.cacheTTL, "auth-cache-ttl", 30*time.Second, "how long token and permission lookups are cached (0 disables the cache)")
+	flag.IntVar(&config.auth.cacheSize, "auth-cache-size", 10_000, "maximum number of entries in each authentication cache")
+	flag.DurationVar(&config.activation.resendInterval, "activation-resend-interval", 5*time.Minute, "minimum interval between activation emails sent to the same address")
+	flag.IntVar(&config.activation.resendBurst, "activation-resend-burst", 2, "activation emails that can be requested back to back for the same address")
+	flag.DurationVar(&config.passwordReset.resendInterval, "password-reset-interval", 5*time.Minute, "minimum interval between password reset emails sent to the same address")
+	flag.IntVar(&config.passwordReset.resendBurst, "password-reset-burst", 2, "password reset emails that can be requested back to back for the same address")
+	flag.BoolVar(&config.registration.concealExisting, "registration-conceal-existing", false, "accept every registration and email the owner when the address is already registered")
+	flag.BoolVar(&config.permissions.sync, "permissions-sync", true, "insert permissions declared by the application but missing from the database at startup")
+	flag.StringVar(&config.registration.defaultRole, "registration-default-role", "viewer", "role given to new users (empty for none)")
+	flag.IntVar(&config.login.backoffAfter, "login-backoff-after", 3, "failed logins allowed before each attempt has to wait")
+	flag.DurationVar(&config.login.backoffBase, "login-backoff-base", time.Second, "wait after the first failed login past login-backoff-after, doubled on every failure")
+	flag.IntVar(&config.login.lockoutThreshold, "login-lockout-threshold", 10, "failed logins for the same email that lock it")
+	flag.IntVar(&config.login.ipLockoutThreshold, "login-ip-lockout-threshold", 50, "failed logins from the same IP that lock it")
+	flag.DurationVar(&config.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "how long a locked email or IP can't log in")
+	flag.DurationVar(&config.login.window, "login-failure-window", time.Hour, "failed logins older than this are forgotten")
+	flag.StringVar(&config.twoFactor.issuer, "2fa-issuer", "IDKN", "issuer shown by authenticator apps for TOTP codes")
+	flag.IntVar(&config.twoFactor.skew, "2fa-skew", 1, "TOTP time steps accepted on either side of the current one")
+	flag.DurationVar(&config.twoFactor.loginTTL, "2fa-login-ttl", 5*time.Minute, "time allowed to enter the TOTP code after the password")
+	flag.DurationVar(&config.twoFactor.attemptInterval, "2fa-attempt-interval", 30*time.Second, "minimum interval between TOTP attempts for the same user")
+	flag.IntVar(&config.twoFactor.attemptBurst, "2fa-attempt-burst", 5, "TOTP attempts that can be made back to back for the same user")
+	flag.IntVar(&config.twoFactor.maxAttempts, "2fa-max-attempts", 5, "wrong codes after which the login has to start over from the password")
+	flag.StringVar(&config.passwords.hasher, "password-hasher", "argon2id", "Algorithm new password hashes are made with (argon2id|bcrypt)")
+	flag.IntVar(&config.passwords.bcryptCost, "password-bcrypt-cost", 12, "bcrypt cost when password-hasher is bcrypt")
+	flag.UintVar(&config.passwords.argon2Memory, "password-argon2-memory", uint(data.DefaultArgon2idParams.Memory), "argon2id memory in KiB")
+	flag.UintVar(&config.passwords.argon2Iterations, "password-argon2-iterations", uint(data.DefaultArgon2idParams.Iterations), "argon2id iterations")
+	flag.UintVar(&config.passwords.argon2Parallelism, "password-argon2-parallelism", uint(data.DefaultArgon2idParams.Parallelism), "argon2id parallelism")
+	flag.IntVar(&config.passwords.minLength, "password-min-length", 8, "minimum length of new passwords in bytes")
+	flag.IntVar(&config.passwords.minScore, "password-min-score", 2, "minimum strength score of new passwords, from 0 to 4")
+	flag.BoolVar(&config.passwords.rejectPersonal, "password-reject-personal", true, "refuse new passwords containing the user's name or email")
+	flag.BoolVar(&config.passwords.breachedCheck, "password-breached-check", true, "refuse new passwords found in the breached passwords list")
+	flag.StringVar(&config.passwords.breachedDir, "password-breached-dir", "", "directory of Pwned Passwords range files (<PREFIX>.txt), instead of the shipped list of common passwords")
+	flag.DurationVar(&config.cleanup.interval, "cleanup-interval", time.Hour, "how often expired tokens and stale accounts are cleaned up (0 disables the cleanup)")
+	flag.IntVar(&config.cleanup.batchSize, "cleanup-batch-size", 1000, "rows deleted per statement by the cleanup")
+	flag.DurationVar(&config.cleanup.unactivatedAfter, "cleanup-unactivated-after", 30*24*time.Hour, "age at which accounts never activated are deleted (0 keeps them)")
+	flag.DurationVar(&config.cleanup.warningPeriod, "cleanup-warning-period", 7*24*time.Hour, "how long before their deletion owners of accounts never activated are warned")
+	flag.StringVar(&config.oidc.providersFile, "oidc-providers", "", "JSON file listing the OpenID Connect providers users can log in with")
+	flag.DurationVar(&config.oidc.stateTTL, "oidc-state-ttl", 10*time.Minute, "time allowed to complete an OpenID Connect login")
+	flag.DurationVar(&config.stats.cacheTTL, "stats-cache-ttl", time.Minute, "how long catalogue statistics are cached (0 disables the cache)")
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 	flag.Parse()
@@ -83,6 +218,12 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if err = setPasswordHasher(&app.config); err != nil {
+		app.logger.PrintFatal(err, nil)
+	}
+	if err = setPasswordPolicy(&app.config); err != nil {
+		app.logger.PrintFatal(err, nil)
+	}
 
 	connect, err := initDB(&app.config)
 
@@ -93,6 +234,27 @@ func main() {
 	defer connect.Close()
 	app.models = data.NewModels(connect)
 
+	app.authenticator, err = app.newAuthenticator()
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+	}
+	app.oidcProviders, err = app.newOIDCProviders()
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+	}
+	if err = app.checkPermissions(app.config.permissions.sync); err != nil {
+		app.logger.PrintFatal(err, nil)
+	}
+	if role := app.config.registration.defaultRole; role != "" {
+		exists, err := app.models.Roles.Exists(role)
+		if err != nil {
+			app.logger.PrintFatal(err, nil)
+		}
+		if !exists {
+			app.logger.PrintFatal(fmt.Errorf("default role %q does not exist", role), nil)
+		}
+	}
+
 	//metrics
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
@@ -108,6 +270,8 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	app.startCleanupWorker()
+
 	err = app.server()
 	if err != nil {
 		app.logger.PrintFatal(err, nil)
@@ -133,6 +297,8 @@ func initConfigApp(cfg *config) (*application, error) {
 	cfg.smtp.port = portSmtp
 	cfg.smtp.username = os.Getenv("EMAIL_USERNAME")
 	cfg.smtp.password = os.Getenv("EMAIL_PASSWORD")
+	cfg.auth.signingKeys = os.Getenv("AUTH_SIGNING_KEYS")
+	cfg.auth.signingKeyID = os.Getenv("AUTH_SIGNING_KEY_ID")
 
 	app := &application{
 		config: *cfg,
@@ -149,10 +315,75 @@ func initConfigApp(cfg *config) (*application, error) {
 			enabled bool
 		}{2, 4, true},
 	}
+	if cfg.cleanup.batchSize < 1 {
+		return nil, fmt.Errorf("cleanup-batch-size must be at least 1")
+	}
+	if cfg.cleanup.unactivatedAfter > 0 && cfg.cleanup.warningPeriod >= cfg.cleanup.unactivatedAfter {
+		return nil, fmt.Errorf("cleanup-warning-period must be shorter than cleanup-unactivated-after")
+	}
+	app.trustedProxies, err = parseTrustedProxies(cfg.trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	app.shutdown = make(chan struct{})
+	app.statsCache.ttl = cfg.stats.cacheTTL
+	app.activationLimiter = newKeyedLimiter(rate.Every(cfg.activation.resendInterval), cfg.activation.resendBurst)
+	app.resetLimiter = newKeyedLimiter(rate.Every(cfg.passwordReset.resendInterval), cfg.passwordReset.resendBurst)
+	app.authCache = newAuthCache(cfg.auth.cacheTTL, cfg.auth.cacheSize)
+	app.twoFactorLimiter = newKeyedLimiter(rate.Every(cfg.twoFactor.attemptInterval), cfg.twoFactor.attemptBurst)
 
 	return app, nil
 }
 
+// setPasswordHasher picks the hasher for new passwords. Users whose hash was
+// made differently get a new one the next time they log in.
+func setPasswordHasher(cfg *config) error {
+	switch cfg.passwords.hasher {
+	case "argon2id":
+		params := data.DefaultArgon2idParams
+		params.Memory = uint32(cfg.passwords.argon2Memory)
+		params.Iterations = uint32(cfg.passwords.argon2Iterations)
+		params.Parallelism = uint8(cfg.passwords.argon2Parallelism)
+		if params.Memory < 8*uint32(params.Parallelism) || params.Iterations < 1 || params.Parallelism < 1 || cfg.passwords.argon2Parallelism > 255 {
+			return fmt.Errorf("invalid argon2id parameters m=%d t=%d p=%d", cfg.passwords.argon2Memory, cfg.passwords.argon2Iterations, cfg.passwords.argon2Parallelism)
+		}
+		return data.SetPasswordHasher(data.Argon2idHasher{Params: params})
+	case "bcrypt":
+		if cfg.passwords.bcryptCost < bcrypt.MinCost || cfg.passwords.bcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return data.SetPasswordHasher(data.BcryptHasher{Cost: cfg.passwords.bcryptCost})
+	default:
+		return fmt.Errorf("unknown password hasher %q", cfg.passwords.hasher)
+	}
+}
+
+func setPasswordPolicy(cfg *config) error {
+	if cfg.passwords.minLength < 1 {
+		return fmt.Errorf("password-min-length must be at least 1")
+	}
+	if cfg.passwords.minScore < 0 || cfg.passwords.minScore > 4 {
+		return fmt.Errorf("password-min-score must be between 0 and 4")
+	}
+	policy := data.PasswordPolicy{
+		MinLength:      cfg.passwords.minLength,
+		MinScore:       cfg.passwords.minScore,
+		RejectPersonal: cfg.passwords.rejectPersonal,
+	}
+	if cfg.passwords.breachedCheck {
+		policy.Breached = data.DefaultBreachedList()
+		if cfg.passwords.breachedDir != "" {
+			list, err := data.NewBreachedListDir(cfg.passwords.breachedDir)
+			if err != nil {
+				return err
+			}
+			policy.Breached = list
+		}
+	}
+	data.SetPasswordPolicy(policy)
+	return nil
+}
+
 func initDB(cfg *config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=%s sslmode=%s",
 		cfg.db.user,
@@ -6,12 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/tomasen/realip"
 	"github.com/v3ronez/IDKN/internal/data"
-	"github.com/v3ronez/IDKN/internal/validator"
 	"golang.org/x/time/rate"
 )
 
@@ -39,77 +36,56 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 }
 
 func (app *application) rateLimitPerClient(next http.Handler) http.Handler {
-	type client struct {
-		limit    *rate.Limiter
-		lastSeen time.Time
-	}
-
-	var (
-		mut     sync.Mutex
-		clients = make(map[string]*client)
-	)
+	return app.perClientRateLimiter(app.limiter.rps, app.limiter.burst)(next)
+}
 
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mut.Lock()
+// perClientRateLimiter builds a per-IP limiter with its own bucket set, so a
+// route can be throttled independently from the rest of the API.
+func (app *application) perClientRateLimiter(rps float64, burst int) func(http.Handler) http.Handler {
+	clients := newKeyedLimiter(rate.Limit(rps), burst)
 
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !clients.allow(app.clientIP(r)) {
+				app.rateLimitExceededResponse(w, r)
+				return
 			}
-			mut.Unlock()
-		}
-	}()
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := realip.FromRequest(r)
-		mut.Lock()
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				limit: rate.NewLimiter(rate.Limit(app.limiter.rps), app.limiter.burst),
-			}
-		}
-
-		clients[ip].lastSeen = time.Now()
-		if !clients[ip].limit.Allow() {
-			mut.Unlock()
-			app.rateLimitExceededResponse(w, r)
-			return
-		}
-		mut.Unlock()
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 		authorizationHeader := r.Header.Get("Authorization")
-		if authorizationHeader == "" {
-			r = app.contextSetUser(r, &data.User{})
+		apiKey := r.Header.Get("X-API-Key")
+		if authorizationHeader == "" && apiKey == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		var (
+			user    *data.User
+			session *authSession
+			err     error
+		)
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
+		switch {
+		case apiKey != "":
+			user, session, err = app.authenticateAPIKey(apiKey, app.clientIP(r))
+		case len(headerParts) == 2 && headerParts[0] == "ApiKey":
+			user, session, err = app.authenticateAPIKey(headerParts[1], app.clientIP(r))
+		case len(headerParts) == 2 && headerParts[0] == "Bearer":
+			user, session, err = app.authenticator.authenticate(headerParts[1])
+		default:
+			err = errInvalidToken
 		}
-
-		token := headerParts[1]
-		v := validator.New()
-		if data.ValidateTokenPlainText(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
-		user, err := app.models.Users.GetForToken(data.ScopeAuthenticaton, token)
 		if err != nil {
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
+			case errors.Is(err, errInvalidToken):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
@@ -117,6 +93,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		req := app.contextSetUser(r, user)
+		req = app.contextSetSession(req, session)
 		next.ServeHTTP(w, req)
 	})
 }
@@ -139,8 +116,7 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-		permissons, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissons, err := app.permissionsFor(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
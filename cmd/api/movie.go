@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/v3ronez/IDKN/internal/data"
 	"github.com/v3ronez/IDKN/internal/validator"
@@ -24,10 +26,12 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:       input.Title,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		Genres:      input.Genres,
+		Status:      data.MovieStatusDraft,
+		SubmittedBy: app.contextGetUser(r).ID,
 	}
 
 	v := validator.New()
@@ -49,14 +53,16 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string
-		Genres  []string
-		filters data.Filters
+		Title        string
+		Genres       []string
+		CollectionID int
+		filters      data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.CollectionID = app.readInt(qs, "collection", 0, v)
 
 	input.filters.Page = app.readInt(qs, "page", 1, v)
 	input.filters.PageSize = app.readInt(qs, "page_size", 20, v)
@@ -65,11 +71,24 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
+	expression, err := app.readFilter(qs, "filter", data.MovieFilterFields)
+	if err != nil {
+		app.invalidFilterResponse(w, r, err)
+		return
+	}
+	input.filters.Expression = expression
+
+	v.Check(input.CollectionID >= 0, "collection", "must be a positive integer")
 	if data.ValidateFields(v, input.filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.filters)
+	canEdit, err := app.hasAnyPermission(r, data.PermissionMovieCreate, data.PermissionMoviePublish)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, int64(input.CollectionID), canEdit, input.filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -85,13 +104,50 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 }
 
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	q := strings.TrimSpace(app.readString(qs, "q", ""))
+	limit := app.readInt(qs, "limit", app.config.suggest.limit, v)
+
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= app.config.suggest.limit, "limit", fmt.Sprintf("must be maximum of %d", app.config.suggest.limit))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Suggest(q, limit, app.config.suggest.timeout)
+	if err != nil {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			// a slow suggestion is a useless one, answer with nothing instead of failing
+			suggestions = []*data.MovieSuggestion{}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err = app.writeJSON(responseEnvelope{"suggestions": suggestions}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	movieID, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
-	movie, err := app.models.Movies.Get(int64(movieID))
+	canEdit, err := app.hasAnyPermission(r, data.PermissionMovieCreate, data.PermissionMoviePublish)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movie, err := app.models.Movies.Get(int64(movieID), canEdit)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -111,13 +167,31 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// updateMovieHandler lets reviewers edit any movie. Other editors may only
+// edit their own drafts, so what they change goes through review before it
+// is published.
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	movieID, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
+	}
+	canEdit, err := app.hasAnyPermission(r, data.PermissionMovieCreate, data.PermissionMoviePublish)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canEdit {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	canPublish, err := app.hasAnyPermission(r, data.PermissionMoviePublish)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	movie, err := app.models.Movies.Get(int64(movieID))
+	movie, err := app.models.Movies.Get(int64(movieID), canEdit)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -127,6 +201,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	if !canPublish {
+		if movie.SubmittedBy != app.contextGetUser(r).ID {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		if movie.Status != data.MovieStatusDraft {
+			app.errorResponse(w, r, http.StatusConflict, "only drafts can be edited, the changes would skip review")
+			return
+		}
+	}
 
 	var input struct {
 		Title   *string       `json:"title"`
@@ -202,3 +286,166 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) submitMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	movie, err := app.models.Movies.Get(int64(movieID), true)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if movie.SubmittedBy != app.contextGetUser(r).ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if err = movie.TransitionTo(data.MovieStatusPendingReview); err != nil {
+		app.invalidStatusTransitionResponse(w, r, movie.Status, data.MovieStatusPendingReview)
+		return
+	}
+	movie.ReviewReason = ""
+
+	if err = app.models.Movies.Update(movie); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.writeJSON(responseEnvelope{"movie": movie}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) reviewMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Decision string `json:"decision"`
+		Reason   string `json:"reason"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittdValue(input.Decision, "approve", "reject"), "decision", "must be approve or reject")
+	v.Check(input.Decision != "reject" || input.Reason != "", "reason", "must be provided when rejecting")
+	v.Check(len(input.Reason) <= 1_000, "reason", "must not be more than 1000 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(int64(movieID), true)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	status, decision := data.MovieStatusPublished, "approved"
+	if input.Decision == "reject" {
+		status, decision = data.MovieStatusDraft, "rejected"
+	}
+	if movie.Status != data.MovieStatusPendingReview {
+		app.invalidStatusTransitionResponse(w, r, movie.Status, status)
+		return
+	}
+	if err = movie.TransitionTo(status); err != nil {
+		app.invalidStatusTransitionResponse(w, r, movie.Status, status)
+		return
+	}
+	movie.ReviewReason = input.Reason
+
+	if err = app.models.Movies.Update(movie); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if movie.SubmittedBy != 0 {
+		app.background(func() {
+			submitter, err := app.models.Users.Get(movie.SubmittedBy)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return
+			}
+			data := map[string]any{
+				"user":     submitter,
+				"movie":    movie,
+				"decision": decision,
+				"reason":   input.Reason,
+			}
+			if err = app.mailer.Send(submitter.Email, "movie_review.tmpl", data); err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	if err = app.writeJSON(responseEnvelope{"movie": movie}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) archiveMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	movie, err := app.models.Movies.Get(int64(movieID), true)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = movie.TransitionTo(data.MovieStatusArchived); err != nil {
+		app.invalidStatusTransitionResponse(w, r, movie.Status, data.MovieStatusArchived)
+		return
+	}
+
+	if err = app.models.Movies.Update(movie); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.writeJSON(responseEnvelope{"movie": movie}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/oidc"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+// newOIDCProviders reads the providers file and runs discovery for each of
+// them. Client secrets stay out of the file, they are read from
+// OIDC_<NAME>_CLIENT_SECRET.
+func (app *application) newOIDCProviders() (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+	if app.config.oidc.providersFile == "" {
+		return providers, nil
+	}
+	b, err := os.ReadFile(app.config.oidc.providersFile)
+	if err != nil {
+		return nil, err
+	}
+	var configs []oidc.Config
+	if err = json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", app.config.oidc.providersFile, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc provider %q needs a name, issuer, client_id and redirect_url", cfg.Name)
+		}
+		if _, exists := providers[cfg.Name]; exists {
+			return nil, fmt.Errorf("oidc provider %q is declared twice", cfg.Name)
+		}
+		env := "OIDC_" + strings.ToUpper(strings.ReplaceAll(cfg.Name, "-", "_")) + "_CLIENT_SECRET"
+		cfg.ClientSecret = os.Getenv(env)
+
+		provider, err := oidc.NewProvider(ctx, cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		providers[cfg.Name] = provider
+	}
+	return providers, nil
+}
+
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	nonce, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	pending := &data.OIDCState{Provider: provider.Name(), Nonce: nonce, Verifier: verifier}
+	if err = app.models.Identities.SaveState(state, pending, app.config.oidc.stateTTL); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	envelope := responseEnvelope{"authorization_url": provider.AuthCodeURL(state, nonce, challenge)}
+	if err = app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+	qs := r.URL.Query()
+	code := app.readString(qs, "code", "")
+	state := app.readString(qs, "state", "")
+
+	v := validator.New()
+	v.Check(qs.Get("error") == "", "error", "the provider refused the login: "+qs.Get("error"))
+	v.Check(code != "", "code", "must be provided")
+	v.Check(state != "", "state", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	pending, err := app.models.Identities.ConsumeState(state, provider.Name())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), code, pending.Verifier, pending.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidToken), errors.Is(err, oidc.ErrUnknownKey), errors.Is(err, oidc.ErrExchange):
+			app.logger.PrintInfo("oidc login refused", map[string]string{"provider": provider.Name(), "error": err.Error()})
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if v.Check(claims.Email != "" && claims.EmailVerified, "email", "must be verified by the provider"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.oidcUser(provider.Name(), claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAccountDeactivated):
+			app.inactiveAccountResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.completeLogin(w, r, user)
+}
+
+// errAccountDeactivated refuses OIDC logins to accounts an admin deactivated.
+var errAccountDeactivated = errors.New("account deactivated")
+
+// oidcUser returns the user the provider's account is linked to, linking it
+// by email, or creating the user, on the first login.
+func (app *application) oidcUser(provider string, claims *oidc.Claims) (*data.User, error) {
+	user, err := app.models.Identities.GetUser(provider, claims.Subject)
+	if err == nil {
+		if !user.Activated {
+			return nil, errAccountDeactivated
+		}
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	user, err = app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// nothing proves whoever registered a never activated account owns
+		// the address, it may be squatted. The provider does, so the account
+		// is activated and the squatter's password dropped. Accounts that
+		// were activated once and are not anymore were deactivated on purpose.
+		if !user.Activated {
+			if err = setRandomPassword(user); err != nil {
+				return nil, err
+			}
+			err = app.models.Users.ActivateNeverActivated(user)
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return nil, errAccountDeactivated
+			case err != nil:
+				return nil, err
+			}
+			app.authCache.invalidateUser(user.ID)
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user = &data.User{Name: claims.Name, Email: claims.Email, Activated: true}
+		if user.Name == "" {
+			user.Name, _, _ = strings.Cut(claims.Email, "@")
+		}
+		if err = setRandomPassword(user); err != nil {
+			return nil, err
+		}
+		if err = app.models.Users.Insert(user); err != nil {
+			return nil, err
+		}
+		if role := app.config.registration.defaultRole; role != "" {
+			if err = app.models.Roles.AddForUser(user.ID, role); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, err
+	}
+
+	if err = app.models.Identities.Link(provider, claims.Subject, user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/validator"
 )
 
 func (app *application) getPermissionsByUserID(w http.ResponseWriter, r *http.Request) {
@@ -27,3 +30,90 @@ func (app *application) getPermissionsByUserID(w http.ResponseWriter, r *http.Re
 		return
 	}
 }
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.writeJSON(responseEnvelope{"permissions": data.PermissionRegistry}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkPermissions compares the permissions table with the registry. Missing
+// codes are inserted when sync is set, otherwise they stop the server: every
+// route needing them would refuse everyone.
+func (app *application) checkPermissions(sync bool) error {
+	stored, err := app.models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+	declared := data.Permissions{}
+	missing := []string{}
+	for _, definition := range data.PermissionRegistry {
+		declared = append(declared, definition.Code)
+		if !validator.PermittdValue(definition.Code, stored...) {
+			missing = append(missing, definition.Code)
+		}
+	}
+	for _, code := range stored {
+		if !validator.PermittdValue(code, declared...) {
+			app.logger.PrintInfo("permission in the database is not used by the application", map[string]string{"code": code})
+		}
+	}
+
+	if sync {
+		return app.models.Permissions.Sync(data.PermissionRegistry)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("permissions missing from the database: %s (run the migrations or start with -permissions-sync)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// permissionsFor returns the permissions of the request's user, taking them
+// from the access token when it carries them.
+func (app *application) permissionsFor(r *http.Request) (data.Permissions, error) {
+	session := app.contextGetSession(r)
+	if session.scoped {
+		return session.permissions, nil
+	}
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return data.Permissions{}, nil
+	}
+	permissions, found := app.authCache.userPermissions(user.ID)
+	if !found {
+		generation := app.authCache.permissionsGeneration()
+		var err error
+		permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		app.authCache.setUserPermissions(user.ID, permissions, generation)
+	}
+	if session.apiKey == nil {
+		return permissions, nil
+	}
+
+	// an API key only keeps the permissions its owner still holds
+	scoped := data.Permissions{}
+	for _, code := range session.apiKey.Permissions {
+		if permissions.Includes(code) {
+			scoped = append(scoped, code)
+		}
+	}
+	return scoped, nil
+}
+
+// hasAnyPermission reports whether the request's user holds at least one of
+// the codes.
+func (app *application) hasAnyPermission(r *http.Request, codes ...string) (bool, error) {
+	permissions, err := app.permissionsFor(r)
+	if err != nil {
+		return false, err
+	}
+	for _, code := range codes {
+		if permissions.Includes(code) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
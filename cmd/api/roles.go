@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll(0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"roles": roles}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = data.Permissions{}
+	}
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = app.models.Roles.Insert(role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"role": role}, w, http.StatusCreated, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	role, err := app.models.Roles.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"role": role}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	role, err := app.models.Roles.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if input.Permissions != nil && !role.Permissions.Includes(data.PermissionUsersAdmin) {
+		holds, err := app.holdsAdminRole(r, role.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if holds {
+			v.AddError("permissions", "you can't take "+data.PermissionUsersAdmin+" away from a role of yours")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+	holders, err := app.models.Roles.GetUserIDs(role.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.models.Roles.Update(role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidateAllPermissions()
+	if input.Permissions != nil {
+		if err = app.revokeAccessTokens(holders); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if err = app.writeJSON(responseEnvelope{"role": role}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	holds, err := app.holdsAdminRole(r, int64(id))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if holds {
+		v := validator.New()
+		v.AddError("id", "you can't delete a role granting you "+data.PermissionUsersAdmin)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	holders, err := app.models.Roles.GetUserIDs(int64(id))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.models.Roles.Delete(int64(id)); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidateAllPermissions()
+	if err = app.revokeAccessTokens(holders); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"message": "role successfully deleted"}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) assignUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Roles) >= 1, "roles", "must contain at least 1 role")
+	for _, name := range input.Roles {
+		exists, err := app.models.Roles.Exists(name)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(exists, "roles", "must only contain existing roles")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Roles.AddForUser(user.ID, input.Roles...); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.authCache.invalidatePermissions(user.ID)
+	app.writeUserRoles(w, r, user.ID)
+}
+
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	name := chi.URLParam(r, "name")
+	if user.ID == app.contextGetUser(r).ID {
+		roles, err := app.models.Roles.GetAll(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, role := range roles {
+			if role.Name == name && role.Permissions.Includes(data.PermissionUsersAdmin) {
+				v := validator.New()
+				v.AddError("name", "you can't remove a role granting you "+data.PermissionUsersAdmin)
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+		}
+	}
+	if err := app.models.Roles.RemoveForUser(user.ID, name); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.authCache.invalidatePermissions(user.ID)
+	if err := app.authenticator.revokeAccessTokens(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserRoles(w, r, user.ID)
+}
+
+func (app *application) writeUserRoles(w http.ResponseWriter, r *http.Request, userID int64) {
+	roles, err := app.models.Roles.GetAll(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"roles": roles}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// holdsAdminRole reports whether the request's user holds the role and the
+// role grants them users:admin.
+func (app *application) holdsAdminRole(r *http.Request, roleID int64) (bool, error) {
+	roles, err := app.models.Roles.GetAll(app.contextGetUser(r).ID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if role.ID == roleID && role.Permissions.Includes(data.PermissionUsersAdmin) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// revokeAccessTokens revokes the access tokens of the users who held a role
+// that lost permissions.
+func (app *application) revokeAccessTokens(userIDs []int64) error {
+	for _, id := range userIDs {
+		if err := app.authenticator.revokeAccessTokens(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,13 +5,14 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/v3ronez/IDKN/internal/data"
 )
 
 func (app *application) routes() *chi.Mux {
 	routes := chi.NewRouter()
 	routes.Use(app.recoverPanic)
 	// routes.Use(app.rateLimitPerClient)
-	// routes.Use(app.authenticate)
+	routes.Use(app.authenticate)
 	routes.Use(app.Metrics)
 	routes.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		app.notFoundResponse(w, r)
@@ -20,22 +21,87 @@ func (app *application) routes() *chi.Mux {
 		app.methodNotAllowedResponse(w, r)
 	})
 	routes.Get("/v1/healthcheck", app.requireActivatedUser(app.healthcheckHandler))
+	routes.With(app.perClientRateLimiter(app.config.suggest.rps, app.config.suggest.burst)).
+		Get("/v1/movies/suggest", app.requireActivatedUser(app.requirePermission(data.PermissionMovieRead, app.suggestMoviesHandler)))
 	routes.Get("/v1/movies/{ID}", app.requireActivatedUser(app.showMovieHandler))
-	routes.Get("/v1/movies", app.requireActivatedUser(app.requirePermission("movie:read", app.listMoviesHandler)))
+	routes.Get("/v1/movies", app.requireActivatedUser(app.requirePermission(data.PermissionMovieRead, app.listMoviesHandler)))
 	// routes.Put("/v1/movies/{ID}", app.updateMovieHandler)
 	routes.Patch("/v1/movies/{ID}", app.requireActivatedUser(app.updateMovieHandler))
-	routes.Post("/v1/movies", app.requirePermission("movie:create", app.requireActivatedUser(app.createMovieHandler)))
+	routes.Post("/v1/movies", app.requirePermission(data.PermissionMovieCreate, app.requireActivatedUser(app.createMovieHandler)))
 	routes.Delete("/v1/movies/{ID}", app.requireActivatedUser(app.deleteMovieHandler))
+	routes.Post("/v1/movies/{ID}/submit", app.requireActivatedUser(app.requirePermission(data.PermissionMovieCreate, app.submitMovieHandler)))
+	routes.Post("/v1/movies/{ID}/review", app.requireActivatedUser(app.requirePermission(data.PermissionMoviePublish, app.reviewMovieHandler)))
+	routes.Post("/v1/movies/{ID}/archive", app.requireActivatedUser(app.requirePermission(data.PermissionMoviePublish, app.archiveMovieHandler)))
+
+	//collections
+	routes.Get("/v1/collections", app.requireActivatedUser(app.requirePermission(data.PermissionMovieRead, app.listCollectionsHandler)))
+	routes.Get("/v1/collections/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionMovieRead, app.showCollectionHandler)))
+	routes.Get("/v1/collections/{ID}/movies", app.requireActivatedUser(app.requirePermission(data.PermissionMovieRead, app.listCollectionMoviesHandler)))
+	routes.Post("/v1/collections", app.requireActivatedUser(app.requirePermission(data.PermissionCollectionWrite, app.createCollectionHandler)))
+	routes.Patch("/v1/collections/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionCollectionWrite, app.updateCollectionHandler)))
+	routes.Delete("/v1/collections/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionCollectionWrite, app.deleteCollectionHandler)))
+
+	//stats
+	routes.Get("/v1/stats/movies", app.requireActivatedUser(app.requirePermission(data.PermissionStatsRead, app.movieStatsHandler)))
 
 	//user
 	routes.Post("/v1/users", app.registerUserHandler)
 	routes.Put("/v1/users/activated", app.activateUserHandler)
+	routes.Put("/v1/users/password", app.updateUserPasswordHandler)
+
+	routes.Get("/v1/users/me", app.requireActivatedUser(app.showCurrentUserHandler))
+	routes.Patch("/v1/users/me", app.requireActivatedUser(app.requireInteractiveUser(app.updateCurrentUserHandler)))
+
+	routes.Post("/v1/users/me/email", app.requireActivatedUser(app.requireInteractiveUser(app.requestEmailChangeHandler)))
+	routes.Put("/v1/users/email", app.confirmEmailChangeHandler)
+
+	//sessions
+	routes.Get("/v1/users/me/sessions", app.requireActivatedUser(app.requireInteractiveUser(app.listSessionsHandler)))
+	routes.Delete("/v1/users/me/sessions", app.requireActivatedUser(app.requireInteractiveUser(app.deleteAllSessionsHandler)))
+	routes.Delete("/v1/users/me/sessions/{ID}", app.requireActivatedUser(app.requireInteractiveUser(app.deleteSessionHandler)))
+
+	//two-factor
+	routes.Post("/v1/users/me/2fa", app.requireActivatedUser(app.requireInteractiveUser(app.requirePermission(data.PermissionMovieCreate, app.enrolTwoFactorHandler))))
+	routes.Put("/v1/users/me/2fa", app.requireActivatedUser(app.requireInteractiveUser(app.requirePermission(data.PermissionMovieCreate, app.confirmTwoFactorHandler))))
+
+	//api keys
+	routes.Get("/v1/users/me/api-keys", app.requireActivatedUser(app.requireInteractiveUser(app.listAPIKeysHandler)))
+	routes.Post("/v1/users/me/api-keys", app.requireActivatedUser(app.requireInteractiveUser(app.createAPIKeyHandler)))
+	routes.Post("/v1/users/me/api-keys/{ID}/rotate", app.requireActivatedUser(app.requireInteractiveUser(app.rotateAPIKeyHandler)))
+	routes.Delete("/v1/users/me/api-keys/{ID}", app.requireActivatedUser(app.requireInteractiveUser(app.deleteAPIKeyHandler)))
 
 	// permissions
+	routes.Get("/v1/permissions", app.requireActivatedUser(app.listPermissionsHandler))
 	routes.Get("/v1/users/permissions/{ID}", app.getPermissionsByUserID)
 
+	//admin
+	routes.Get("/v1/admin/users", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.listUsersHandler)))
+	routes.Get("/v1/admin/users/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.showUserHandler)))
+	routes.Put("/v1/admin/users/{ID}/activated", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.setUserActivatedHandler)))
+	routes.Post("/v1/admin/users/{ID}/password-reset", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.forcePasswordResetHandler)))
+	routes.Delete("/v1/admin/users/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.deleteUserHandler)))
+	routes.Post("/v1/admin/users/{ID}/permissions", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.grantUserPermissionsHandler)))
+	routes.Delete("/v1/admin/users/{ID}/permissions/{code}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.revokeUserPermissionHandler)))
+
+	routes.Post("/v1/admin/users/{ID}/roles", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.assignUserRolesHandler)))
+	routes.Delete("/v1/admin/users/{ID}/roles/{name}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.removeUserRoleHandler)))
+	routes.Get("/v1/admin/roles", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.listRolesHandler)))
+	routes.Post("/v1/admin/roles", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.createRoleHandler)))
+	routes.Get("/v1/admin/roles/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.showRoleHandler)))
+	routes.Patch("/v1/admin/roles/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.updateRoleHandler)))
+	routes.Delete("/v1/admin/roles/{ID}", app.requireActivatedUser(app.requirePermission(data.PermissionUsersAdmin, app.deleteRoleHandler)))
+
 	//token
-	routes.Post("/v1/tokens/authentication", app.createAutheticationTokenHandler)
+	routes.With(app.rateLimitPerClient).Post("/v1/tokens/authentication", app.createAutheticationTokenHandler)
+	routes.Delete("/v1/tokens/authentication", app.requireActivatedUser(app.requireInteractiveUser(app.deleteAuthenticationTokenHandler)))
+	routes.Post("/v1/tokens/two-factor", app.createTwoFactorTokenHandler)
+	routes.Post("/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	routes.Post("/v1/tokens/activation", app.createActivationTokenHandler)
+	routes.With(app.rateLimitPerClient).Post("/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	//oidc
+	routes.With(app.rateLimitPerClient).Get("/v1/oidc/{provider}/login", app.oidcLoginHandler)
+	routes.With(app.rateLimitPerClient).Get("/v1/oidc/{provider}/callback", app.oidcCallbackHandler)
 
 	//metrics
 	routes.Get("/debug/vars", expvar.Handler().ServeHTTP)
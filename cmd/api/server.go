@@ -40,6 +40,8 @@ func (app *application) server() error {
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": serv.Addr})
 
+		close(app.shutdown)
+
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
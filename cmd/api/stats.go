@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+)
+
+// statsCache keeps the last computed catalogue statistics for ttl. A zero ttl
+// disables caching.
+type statsCache struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	stats  *data.MovieStats
+	expiry time.Time
+}
+
+func (c *statsCache) get(load func() (*data.MovieStats, error)) (*data.MovieStats, error) {
+	if c.ttl <= 0 {
+		return load()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats != nil && time.Now().Before(c.expiry) {
+		return c.stats, nil
+	}
+	stats, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	c.expiry = time.Now().Add(c.ttl)
+	return stats, nil
+}
+
+func (app *application) movieStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.statsCache.get(func() (*data.MovieStats, error) {
+		return app.models.Stats.Movies(10)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(responseEnvelope{"stats": stats}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter keeps one token bucket per key (an IP, an email...). Buckets
+// that have been idle long enough to be full again are dropped.
+type keyedLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	idle    time.Duration
+	clients map[string]*keyedClient
+}
+
+type keyedClient struct {
+	limit    *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rate.Limit, burst int) *keyedLimiter {
+	idle := 3 * time.Minute
+	if refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second)); refill > idle {
+		idle = refill
+	}
+	l := &keyedLimiter{
+		limit:   limit,
+		burst:   burst,
+		idle:    idle,
+		clients: make(map[string]*keyedClient),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			l.mu.Lock()
+			for key, client := range l.clients {
+				if time.Since(client.lastSeen) > l.idle {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+func (l *keyedLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, found := l.clients[key]
+	if !found {
+		client = &keyedClient{limit: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limit.Allow()
+}
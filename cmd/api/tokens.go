@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/v3ronez/IDKN/internal/data"
@@ -20,37 +21,285 @@ func (app *application) createAutheticationTokenHandler(w http.ResponseWriter, r
 	}
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePaswordPlainText(v, input.Password)
+	// the policy is for new passwords, older ones must still log in.
+	v.Check(input.Password != "", "password", "must be provided")
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+
+	attempt, retryAfter, err := app.reserveLogin(input.Email, app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if attempt == nil {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+
+	// unknown emails go through the same checks and failure accounting as
+	// wrong passwords.
 	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	match := false
+	if user != nil {
+		match, err = user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		data.CompareDummyPassword(input.Password)
+	}
+	if !match {
+		if err = app.loginFailed(attempt, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	if err = app.loginSucceeded(attempt); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		if err := app.models.Users.Rehash(user, input.Password); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin asks for the second factor when the user has enabled it and
+// otherwise starts their session.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf != nil && tf.Enabled {
+		token, err := app.models.Tokens.New(user.ID, app.config.twoFactor.loginTTL, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		envelope := responseEnvelope{
+			"two_factor_token": token,
+			"message":          "a TOTP code is required to complete the login",
+		}
+		if err = app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.startSession(w, r, user)
+}
+
+// startSession opens a new session for a user who just proved who they are
+// and writes its tokens.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	refresh, err := app.models.Tokens.NewRefresh(user.ID, app.config.auth.refreshTTL, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	access, err := app.authenticator.issue(user, refresh.Family, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	envelope := responseEnvelope{
+		"authentication_token:": access,
+		"refresh_token":         refresh,
+	}
+	if err := app.writeJSON(envelope, w, http.StatusCreated, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.auth.refreshTTL, app.clientIP(r), r.UserAgent())
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.PrintInfo("refresh token reuse detected, token family revoked", map[string]string{
+				"ip": app.clientIP(r),
+			})
+			if err = app.authenticator.revokeSession(refresh.UserID, refresh.Family, ""); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidAuthenticationTokenResponse(w, r)
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+			app.invalidAuthenticationTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	match, err := user.Password.Matches(input.Password)
+
+	user, err := app.models.Users.Get(refresh.UserID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	if !match {
-		app.invalidCredentialsResponse(w, r)
+	access, err := app.authenticator.issue(user, refresh.Family, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	t, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthenticaton)
+	envelope := responseEnvelope{
+		"authentication_token:": access,
+		"refresh_token":         refresh,
+	}
+	if err = app.writeJSON(envelope, w, http.StatusCreated, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the lookup and the email happen in the background so the response is
+	// the same, in content and timing, whether the account exists or not.
+	// Throttled requests get that same response, without the email.
+	if !app.resetLimiter.allow(strings.ToLower(input.Email)) {
+		app.passwordResetAcceptedResponse(w, r)
+		return
+	}
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		data := map[string]any{
+			"passwordResetToken": token.PlainText,
+		}
+		if err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	app.passwordResetAcceptedResponse(w, r)
+}
+
+// passwordResetAcceptedResponse is the answer to every password reset
+// request, whether an email is sent or not.
+func (app *application) passwordResetAcceptedResponse(w http.ResponseWriter, r *http.Request) {
+	envelope := responseEnvelope{"message": "if an account exists for that email, you will receive password reset instructions"}
+	if err := app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.activationLimiter.allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	if err := app.writeJSON(responseEnvelope{"authentication_token:": t}, w, http.StatusCreated, nil); err != nil {
+
+	app.background(func() {
+		data := map[string]any{
+			"activationToken": token.PlainText,
+		}
+		if err := app.mailer.Send(user.Email, "token_activation.tmpl", data); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	envelope := responseEnvelope{"message": "an email will be sent to you containing activation instructions"}
+	if err = app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	session := app.contextGetSession(r)
+	if err := app.authenticator.revokeSession(user.ID, session.family, session.token); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(responseEnvelope{"message": "you have been logged out"}, w, http.StatusOK, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/v3ronez/IDKN/internal/data"
+	"github.com/v3ronez/IDKN/internal/totp"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+func (app *application) enrolTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// the user in the context may only carry an ID, the email is needed for
+	// the label shown by authenticator apps.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.models.TwoFactor.Enrol(user.ID, secret); err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.twoFactorEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	envelope := responseEnvelope{"two_factor": map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(secret, app.config.twoFactor.issuer, user.Email),
+	}}
+	if err = app.writeJSON(envelope, w, http.StatusCreated, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "two-factor enrolment must be started first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if tf.Enabled {
+		app.twoFactorEnabledResponse(w, r)
+		return
+	}
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now(), app.config.twoFactor.skew)
+	if !ok {
+		v.AddError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.models.TwoFactor.Enable(user.ID, step, hashes); err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.twoFactorEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"recovery_codes": codes}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTwoFactorTokenHandler is the second step of a login with 2FA: it
+// trades the token returned for the password, plus a TOTP or recovery code,
+// for a session.
+func (app *application) createTwoFactorTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token        string `json:"token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateTokenPlainText(v, input.Token)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.twoFactorLimiter.allow(strconv.FormatInt(user.ID, 10)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+	// counted before the code is checked, parallel guesses can't get past
+	// the limit.
+	err = app.models.Tokens.CountAttempt(data.ScopeTwoFactor, input.Token, app.config.twoFactor.maxAttempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteByPlainText(data.ScopeTwoFactor, input.Token)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.startSession(w, r, user)
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code when one is
+// given, consuming it.
+func (app *application) verifySecondFactor(userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := app.models.TwoFactor.UseRecoveryCode(userID, recoveryCode)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return true, nil
+	}
+
+	tf, err := app.models.TwoFactor.Get(userID)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(tf.Secret, code, time.Now(), app.config.twoFactor.skew)
+	if !ok {
+		return false, nil
+	}
+	err = app.models.TwoFactor.UseStep(userID, step)
+	switch {
+	case errors.Is(err, data.ErrCodeReplayed):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/v3ronez/IDKN/internal/data"
@@ -42,6 +43,14 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	if err := app.models.Users.Insert(user); err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateEmail) && app.config.registration.concealExisting:
+			app.background(func() {
+				if err := app.mailer.Send(user.Email, "user_exists.tmpl", nil); err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+			app.registrationAcceptedResponse(w, r)
+			return
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "email already exits")
 			app.failedValidationResponse(w, r, v.Errors)
@@ -51,10 +60,11 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			return
 		}
 	}
-	err = app.models.Permissions.AddForUser(user.ID, "movie:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+	if role := app.config.registration.defaultRole; role != "" {
+		if err = app.models.Roles.AddForUser(user.ID, role); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 	}
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
@@ -74,12 +84,26 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 	})
 
+	if app.config.registration.concealExisting {
+		app.registrationAcceptedResponse(w, r)
+		return
+	}
 	if err := app.writeJSON(responseEnvelope{"user": *user}, w, http.StatusCreated, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
+// registrationAcceptedResponse is the answer to every registration when
+// existing accounts are concealed, whether an account was created or the
+// owner of the email was notified instead.
+func (app *application) registrationAcceptedResponse(w http.ResponseWriter, r *http.Request) {
+	envelope := responseEnvelope{"message": "an email will be sent to you containing activation instructions"}
+	if err := app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		TokenPlaintext string `json:"token"`
@@ -111,6 +135,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 			return
 		}
 	}
+	app.authCache.invalidateUser(user.ID)
 
 	if err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID); err != nil {
 		switch {
@@ -128,3 +153,304 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 }
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	// the policy needs the user's name and email, it is checked once the
+	// token gave the user.
+	v.Check(input.Password != "", "password", "must be provided")
+	data.ValidateTokenPlainText(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if data.ValidatePaswordPlainText(v, input.Password, user.Name, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = user.Password.Set(input.Password); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.models.Users.Update(user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err = app.authenticator.revokeUser(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	envelope := responseEnvelope{"message": "your password was successfully reset"}
+	if err = app.writeJSON(envelope, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err = app.writeJSON(responseEnvelope{"user": user}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Password != nil {
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided to change the password")
+		if input.CurrentPassword != "" {
+			// a stolen session must not get unlimited guesses at the
+			// password, they are throttled like logins.
+			attempt, retryAfter, err := app.reserveLogin(user.Email, app.clientIP(r))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if attempt == nil {
+				app.loginThrottledResponse(w, r, retryAfter)
+				return
+			}
+			match, err := user.Password.Matches(input.CurrentPassword)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if match {
+				err = app.loginSucceeded(attempt)
+			} else {
+				err = app.loginFailed(attempt, user)
+			}
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			v.Check(match, "current_password", "is incorrect")
+		}
+		if err = user.Password.Set(*input.Password); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err = app.models.Users.Update(user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidateUser(user.ID)
+
+	if input.Password != nil {
+		if err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if err = app.authenticator.revokeOtherSessions(user.ID, app.contextGetSession(r).family); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if err = app.writeJSON(responseEnvelope{"user": user}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// throttled like logins, a stolen session must not get unlimited
+	// guesses at the password.
+	attempt, retryAfter, err := app.reserveLogin(user.Email, app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if attempt == nil {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if match {
+		err = app.loginSucceeded(attempt)
+	} else {
+		err = app.loginFailed(attempt, user)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v.Check(match, "password", "is incorrect")
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the address is checked again on confirmation, this only spares an email
+	// that can't succeed. It is skipped when registered emails are concealed.
+	if !app.config.registration.concealExisting {
+		_, err = app.models.Users.GetByEmail(input.Email)
+		switch {
+		case err == nil:
+			v.AddError("email", "email already exits")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	token, err := app.models.EmailChange.New(user.ID, input.Email, 24*time.Hour)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		data := map[string]any{
+			"emailChangeToken": token.PlainText,
+			"newEmail":         input.Email,
+		}
+		if err := app.mailer.Send(input.Email, "email_change_confirm.tmpl", data); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		if err := app.mailer.Send(user.Email, "email_change_notice.tmpl", data); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	envelope := responseEnvelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+	if err = app.writeJSON(envelope, w, http.StatusAccepted, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.EmailChange.Confirm(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "email already exits")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.authCache.invalidateUser(user.ID)
+	if err = app.writeJSON(responseEnvelope{"user": user}, w, http.StatusOK, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,264 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+const apiKeyPrefix = "idkn_"
+
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	PlainText   string      `json:"key,omitempty"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	IPAllowlist []string    `json:"ip_allowlist"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Version     int32       `json:"version"`
+}
+
+// AllowsIP reports whether ip is covered by the key's allowlist. An empty
+// allowlist allows every address.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.IPAllowlist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range k.IPAllowlist {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) Expired() bool {
+	return k.Expiry != nil && !k.Expiry.After(time.Now())
+}
+
+// ValidateAPIKey checks the key against the permissions of its owner, a key
+// can never grant more than the user has.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, ownerPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(ownerPermissions.Includes(code), "permissions", "must only contain permissions you hold")
+	}
+	v.Check(len(key.IPAllowlist) <= 20, "ip_allowlist", "must not contain more than 20 entries")
+	for _, entry := range key.IPAllowlist {
+		_, _, cidrErr := net.ParseCIDR(entry)
+		v.Check(cidrErr == nil || net.ParseIP(entry) != nil, "ip_allowlist", "must only contain IP addresses or CIDR ranges")
+	}
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// LooksLikeAPIKey reports whether s has the shape of an API key, so obviously
+// malformed keys are rejected without a lookup.
+func LooksLikeAPIKey(s string) bool {
+	return strings.HasPrefix(s, apiKeyPrefix) && len(s) == len(apiKeyPrefix)+52
+}
+
+func generateAPIKeySecret(key *APIKey) error {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return err
+	}
+	key.PlainText = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes)
+	key.Prefix = key.PlainText[:len(apiKeyPrefix)+6]
+	hash := sha256.Sum256([]byte(key.PlainText))
+	key.Hash = hash[:]
+	return nil
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert generates the key's secret and stores it hashed. The plain text is
+// only available on the returned key.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	if err := generateAPIKeySecret(key); err != nil {
+		return err
+	}
+	if key.IPAllowlist == nil {
+		key.IPAllowlist = []string{}
+	}
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, ip_allowlist, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, version`
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), pq.Array(key.IPAllowlist), key.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, created_at, name, prefix, permissions, ip_allowlist, expiry, last_used_at, version
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.CreatedAt,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			pq.Array(&key.IPAllowlist),
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetForKey returns the key matching plainText and its owner, recording the
+// use. Expiry and IP restrictions are left to the caller.
+func (m APIKeyModel) GetForKey(plainText string) (*APIKey, *User, error) {
+	hash := sha256.Sum256([]byte(plainText))
+	query := `
+		WITH touched AS (
+			UPDATE api_keys SET last_used_at = NOW()
+			WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		)
+		SELECT k.id, k.user_id, k.created_at, k.name, k.prefix, k.permissions, k.ip_allowlist, k.expiry, k.last_used_at, k.version,
+			u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.version
+		FROM api_keys k
+		INNER JOIN users u ON u.id = k.user_id
+		WHERE k.hash = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.IPAllowlist),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &key, &user, nil
+}
+
+// Rotate replaces the secret of one of the user's keys, the old one stops
+// working immediately.
+func (m APIKeyModel) Rotate(userID, id int64) (*APIKey, error) {
+	var key APIKey
+	if err := generateAPIKeySecret(&key); err != nil {
+		return nil, err
+	}
+	query := `
+		UPDATE api_keys SET prefix = $1, hash = $2, version = version + 1
+		WHERE id = $3 AND user_id = $4
+		RETURNING id, user_id, created_at, name, permissions, ip_allowlist, expiry, last_used_at, version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, key.Prefix, key.Hash, id, userID).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.CreatedAt,
+		&key.Name,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.IPAllowlist),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+func (m APIKeyModel) Delete(userID, id int64) error {
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
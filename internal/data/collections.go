@@ -0,0 +1,264 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+var ErrInvalidCollectionMovie = errors.New("collection references a movie that does not exist")
+
+type Collection struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	MovieIDs    []int64   `json:"movie_ids"`
+	Version     int32     `json:"version"`
+}
+
+func ValidateCollection(v *validator.Validator, collection *Collection) {
+	v.Check(collection.Name != "", "name", "must be provided")
+	v.Check(len(collection.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(len(collection.Description) <= 2_000, "description", "must not be more than 2000 bytes long")
+	v.Check(len(collection.MovieIDs) <= 100, "movie_ids", "must not contain more than 100 movies")
+	v.Check(validator.Unique(collection.MovieIDs), "movie_ids", "must not contain duplicate values")
+}
+
+type CollectionModel struct {
+	DB *sql.DB
+}
+
+// Insert creates the collection and its membership in a single transaction,
+// keeping the order of MovieIDs as the order of the franchise.
+func (c CollectionModel) Insert(collection *Collection) error {
+	query := `
+		INSERT INTO collections (name, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at, version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, collection.Name, collection.Description).Scan(
+		&collection.ID, &collection.CreatedAt, &collection.Version)
+	if err != nil {
+		return err
+	}
+	if err = setCollectionMovies(ctx, tx, collection.ID, collection.MovieIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c CollectionModel) Get(id int64) (*Collection, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT c.id, c.created_at, c.name, c.description, c.version,
+			COALESCE(array_agg(cm.movie_id ORDER BY cm.position) FILTER (WHERE cm.movie_id IS NOT NULL), '{}')
+		FROM collections c
+		LEFT JOIN collections_movies cm ON cm.collection_id = c.id
+		WHERE c.id = $1
+		GROUP BY c.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var collection Collection
+	err := c.DB.QueryRowContext(ctx, query, id).Scan(
+		&collection.ID,
+		&collection.CreatedAt,
+		&collection.Name,
+		&collection.Description,
+		&collection.Version,
+		pq.Array(&collection.MovieIDs),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &collection, nil
+}
+
+func (c CollectionModel) GetAll(name string, filters Filters) ([]*Collection, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), c.id, c.created_at, c.name, c.description, c.version,
+			COALESCE(array_agg(cm.movie_id ORDER BY cm.position) FILTER (WHERE cm.movie_id IS NOT NULL), '{}')
+		FROM collections c
+		LEFT JOIN collections_movies cm ON cm.collection_id = c.id
+		WHERE (to_tsvector('simple', c.name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		GROUP BY c.id
+		ORDER BY %s %s, c.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumns(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var collections []*Collection
+	totalRecords := 0
+	for rows.Next() {
+		var collection Collection
+		err := rows.Scan(
+			&totalRecords,
+			&collection.ID,
+			&collection.CreatedAt,
+			&collection.Name,
+			&collection.Description,
+			&collection.Version,
+			pq.Array(&collection.MovieIDs),
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		collections = append(collections, &collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return collections, metadata, nil
+}
+
+// Update replaces the collection fields and its whole membership list.
+func (c CollectionModel) Update(collection *Collection) error {
+	query := `
+		UPDATE collections
+		SET name = $1, description = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+	args := []any{collection.Name, collection.Description, collection.ID, collection.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&collection.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	if err = setCollectionMovies(ctx, tx, collection.ID, collection.MovieIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c CollectionModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `DELETE FROM collections WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := c.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetMovies returns the movies of a collection in franchise order. Movies
+// sharing a position fall back to release year.
+func (c CollectionModel) GetMovies(collectionID int64, includeUnpublished bool) ([]*Movie, error) {
+	query := `
+		SELECT m.id, m.created_at, m.title, m.year, m.runtime, m.genres, m.status,
+			COALESCE(m.submitted_by, 0), m.review_reason, m.version
+		FROM movies m
+		INNER JOIN collections_movies cm ON cm.movie_id = m.id
+		WHERE cm.collection_id = $1 AND (m.status = 'published' OR $2)
+		ORDER BY cm.position ASC, m.year ASC, m.id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, query, collectionID, includeUnpublished)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Status,
+			&movie.SubmittedBy,
+			&movie.ReviewReason,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+func setCollectionMovies(ctx context.Context, tx *sql.Tx, collectionID int64, movieIDs []int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM collections_movies WHERE collection_id = $1`, collectionID)
+	if err != nil {
+		return err
+	}
+	if len(movieIDs) == 0 {
+		return nil
+	}
+	query := `
+		INSERT INTO collections_movies (collection_id, movie_id, position)
+		SELECT $1, m.id, m.position
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS m(id, position)`
+	_, err = tx.ExecContext(ctx, query, collectionID, pq.Array(movieIDs))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "collections_movies" violates foreign key constraint "collections_movies_movie_id_fkey"`:
+			return ErrInvalidCollectionMovie
+		default:
+			return err
+		}
+	}
+	return nil
+}
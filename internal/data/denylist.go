@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DenylistModel stores revocations of stateless tokens. Keys are opaque to
+// the model, an entry only matters until expiry, when every token it could
+// match has expired anyway.
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+func (d DenylistModel) Add(key string, expiry time.Time) (time.Time, error) {
+	query := `
+		INSERT INTO token_denylist (key, expiry)
+		VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET revoked_at = NOW(), expiry = GREATEST(token_denylist.expiry, EXCLUDED.expiry)
+		RETURNING revoked_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var revokedAt time.Time
+	err := d.DB.QueryRowContext(ctx, query, key, expiry).Scan(&revokedAt)
+	return revokedAt, err
+}
+
+// GetActive returns the revocation time of every entry that hasn't expired.
+func (d DenylistModel) GetActive() (map[string]time.Time, error) {
+	query := `SELECT key, revoked_at FROM token_denylist WHERE expiry > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := d.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var revokedAt time.Time
+		if err := rows.Scan(&key, &revokedAt); err != nil {
+			return nil, err
+		}
+		entries[key] = revokedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DeleteExpired deletes up to limit expired entries and returns how many it
+// deleted.
+func (d DenylistModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		DELETE FROM token_denylist WHERE key IN (
+			SELECT key FROM token_denylist WHERE expiry <= NOW() LIMIT $1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, err := d.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
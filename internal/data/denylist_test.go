@@ -0,0 +1,32 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDenylistDeleteExpired(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	for _, key := range []string{"jti:a", "jti:b", "jti:c"} {
+		if _, err := models.Denylist.Add(key, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := models.Denylist.Add("jti:live", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := models.Denylist.DeleteExpired(2); err != nil || n != 2 {
+		t.Fatalf("first batch: got %d, %v; want 2", n, err)
+	}
+	if n, err := models.Denylist.DeleteExpired(2); err != nil || n != 1 {
+		t.Fatalf("second batch: got %d, %v; want 1", n, err)
+	}
+	entries, err := models.Denylist.GetActive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := entries["jti:live"]; !found || len(entries) != 1 {
+		t.Errorf("got %v, want only the live entry", entries)
+	}
+}
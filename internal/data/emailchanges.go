@@ -0,0 +1,90 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EmailChangeModel keeps the address a user asked to move to next to the
+// token sent there, until the new address confirms it.
+type EmailChangeModel struct {
+	DB *sql.DB
+}
+
+// New replaces any pending change of the user with one to newEmail and
+// returns the token confirming it.
+func (m EmailChangeModel) New(userID int64, newEmail string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, userID, ScopeEmailChange); err != nil {
+		return nil, err
+	}
+	if err = insertToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO email_changes (token_hash, new_email) VALUES ($1, $2)`
+	if _, err = tx.ExecContext(ctx, query, token.Hash, newEmail); err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// Confirm applies the change the token was sent for and consumes it. The new
+// address may have been registered since the change was requested, in which
+// case ErrDuplicateEmail is returned and nothing changes.
+func (m EmailChangeModel) Confirm(tokenPlainText string) (*User, error) {
+	hash := sha256.Sum256([]byte(tokenPlainText))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET email = email_changes.new_email, version = users.version + 1
+		FROM tokens
+		INNER JOIN email_changes ON email_changes.token_hash = tokens.hash
+		WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > NOW() AND users.id = tokens.user_id
+		RETURNING users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version`
+	var user User
+	err = tx.QueryRowContext(ctx, query, hash[:], ScopeEmailChange).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, ScopeEmailChange); err != nil {
+		return nil, err
+	}
+	return &user, tx.Commit()
+}
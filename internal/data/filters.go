@@ -4,6 +4,7 @@ import (
 	"math"
 	"strings"
 
+	"github.com/v3ronez/IDKN/internal/filter"
 	"github.com/v3ronez/IDKN/internal/validator"
 )
 
@@ -12,6 +13,9 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+	// Expression is an already checked filter expression, nil when the
+	// request didn't send one.
+	Expression filter.Node
 }
 
 func ValidateFields(v *validator.Validator, f Filters) {
@@ -39,6 +43,15 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// expression compiles the filter expression against fields, binding its
+// values from the placeholder $firstArg onwards.
+func (f Filters) expression(fields filter.Fields, firstArg int) (string, []any) {
+	if f.Expression == nil {
+		return "TRUE", nil
+	}
+	return filter.Compile(f.Expression, fields, firstArg)
+}
+
 func (f Filters) limit() int {
 	return f.PageSize
 }
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OIDCState is what the login request remembers for its callback: the nonce
+// the ID token must carry and the PKCE verifier for the code exchange.
+type OIDCState struct {
+	Provider string
+	Nonce    string
+	Verifier string
+}
+
+// IdentityModel links users to the accounts they hold with OpenID providers.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// SaveState stores a pending login under the hash of its state parameter.
+func (m IdentityModel) SaveState(statePlainText string, state *OIDCState, ttl time.Duration) error {
+	hash := sha256.Sum256([]byte(statePlainText))
+	query := `
+		INSERT INTO oidc_states (state_hash, provider, nonce, verifier, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+	args := []any{hash[:], state.Provider, state.Nonce, state.Verifier, time.Now().Add(ttl)}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ConsumeState returns and deletes the pending login for the state parameter
+// so that a callback can only be completed once.
+func (m IdentityModel) ConsumeState(statePlainText, provider string) (*OIDCState, error) {
+	hash := sha256.Sum256([]byte(statePlainText))
+	query := `
+		DELETE FROM oidc_states
+		WHERE state_hash = $1 AND provider = $2 AND expiry > NOW()
+		RETURNING provider, nonce, verifier`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var state OIDCState
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider).Scan(&state.Provider, &state.Nonce, &state.Verifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &state, nil
+}
+
+// DeleteExpiredStates deletes the logins that were never completed.
+func (m IdentityModel) DeleteExpiredStates() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetUser returns the user linked to the provider's subject.
+func (m IdentityModel) GetUser(provider, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m IdentityModel) Link(provider, subject string, userID int64) error {
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, provider, subject, userID)
+	return err
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginFailures counts the failed logins made against one key, an email
+// address or a client IP, whether or not an account exists for it.
+type LoginFailures struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get returns the failures recorded for the keys. Keys without failures are
+// left out.
+func (m LoginFailureModel) Get(keys ...string) ([]*LoginFailures, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE key = ANY($1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := []*LoginFailures{}
+	for rows.Next() {
+		var lf LoginFailures
+		if err := rows.Scan(&lf.Key, &lf.Failures, &lf.LastFailureAt, &lf.LockedUntil); err != nil {
+			return nil, err
+		}
+		all = append(all, &lf)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// ErrLoginThrottled is returned by Reserve when the key has to wait before
+// trying again.
+var ErrLoginThrottled = errors.New("login throttled")
+
+// LoginBackoff is how long a key has to wait after a failure: nothing for
+// the first After failures, then Base doubled on every further one, up to Max.
+type LoginBackoff struct {
+	After int
+	Base  time.Duration
+	Max   time.Duration
+}
+
+// Reserve counts an attempt for key as a failure before it is made, and
+// returns the new count. It counts nothing and returns ErrLoginThrottled when
+// key is locked or its backoff hasn't passed. Failures older than window are
+// forgotten and the count starts over.
+//
+// The check and the count are one statement, parallel attempts can't all
+// pass the check before any of them is counted.
+func (m LoginFailureModel) Reserve(key string, window time.Duration, backoff LoginBackoff) (int, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure_at = NOW()
+		WHERE (login_failures.locked_until IS NULL OR login_failures.locked_until <= NOW())
+		AND (
+			login_failures.failures < $3
+			OR login_failures.last_failure_at <= NOW() - make_interval(secs => LEAST($4 * power(2, LEAST(login_failures.failures - $3, 32)), $5))
+		)
+		RETURNING failures`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []any{key, window.Seconds(), backoff.After, backoff.Base.Seconds(), backoff.Max.Seconds()}
+	var failures int
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&failures)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrLoginThrottled
+		default:
+			return 0, err
+		}
+	}
+	return failures, nil
+}
+
+// Release takes back an attempt Reserve counted, for attempts that didn't
+// fail.
+func (m LoginFailureModel) Release(key string) error {
+	query := `UPDATE login_failures SET failures = GREATEST(failures - 1, 0) WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Lock refuses logins for key until the given time and starts counting
+// failures from zero again.
+func (m LoginFailureModel) Lock(key string, until time.Time) error {
+	query := `UPDATE login_failures SET locked_until = $2, failures = 0 WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+func (m LoginFailureModel) Reset(key string) error {
+	query := `DELETE FROM login_failures WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveParallel(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	backoff := LoginBackoff{After: 3, Base: time.Minute, Max: time.Hour}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := models.Logins.Reserve("email:parallel@example.com", time.Hour, backoff)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	reserved := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			reserved++
+		case !errors.Is(err, ErrLoginThrottled):
+			t.Fatal(err)
+		}
+	}
+	// the attempts past the third one wait a minute after it.
+	if reserved != backoff.After+1 {
+		t.Errorf("reserved %d attempts, want %d", reserved, backoff.After+1)
+	}
+}
+
+func TestReserveLocked(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	backoff := LoginBackoff{After: 3, Base: time.Minute, Max: time.Hour}
+	key := "ip:192.0.2.1"
+
+	if _, err := models.Logins.Reserve(key, time.Hour, backoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Logins.Lock(key, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Logins.Reserve(key, time.Hour, backoff); !errors.Is(err, ErrLoginThrottled) {
+		t.Errorf("reserve on a locked key: got %v, want ErrLoginThrottled", err)
+	}
+
+	if err := models.Logins.Lock(key, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	failures, err := models.Logins.Reserve(key, time.Hour, backoff)
+	if err != nil || failures != 1 {
+		t.Errorf("reserve after the lock: got %d, %v; want 1, nil", failures, err)
+	}
+	if err = models.Logins.Release(key); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := models.Logins.Get(key); err != nil || len(all) != 1 || all[0].Failures != 0 {
+		t.Errorf("after release: got %v, %v; want 0 failures", all, err)
+	}
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -13,14 +14,24 @@ var (
 type Models struct {
 	Movies interface {
 		Insert(movie *Movie) error
-		Get(id int64) (*Movie, error)
-		GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+		Get(id int64, includeUnpublished bool) (*Movie, error)
+		GetAll(title string, genres []string, collectionID int64, includeUnpublished bool, filters Filters) ([]*Movie, Metadata, error)
+		Suggest(prefix string, limit int, timeout time.Duration) ([]*MovieSuggestion, error)
 		Update(movie *Movie) error
 		Delete(id int64) error
 	}
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Collections CollectionModel
+	Stats       StatsModel
+	Denylist    DenylistModel
+	APIKeys     APIKeyModel
+	TwoFactor   TwoFactorModel
+	Logins      LoginFailureModel
+	EmailChange EmailChangeModel
+	Roles       RoleModel
+	Identities  IdentityModel
 }
 
 func NewModels(db *sql.DB) Models {
@@ -29,6 +40,15 @@ func NewModels(db *sql.DB) Models {
 		Users:       UserModel{DB: db},
 		Tokens:      TokenModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Collections: CollectionModel{DB: db},
+		Stats:       StatsModel{DB: db},
+		Denylist:    DenylistModel{DB: db},
+		APIKeys:     APIKeyModel{DB: db},
+		TwoFactor:   TwoFactorModel{DB: db},
+		Logins:      LoginFailureModel{DB: db},
+		EmailChange: EmailChangeModel{DB: db},
+		Roles:       RoleModel{DB: db},
+		Identities:  IdentityModel{DB: db},
 	}
 }
 
@@ -5,20 +5,62 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/v3ronez/IDKN/internal/filter"
 	"github.com/v3ronez/IDKN/internal/validator"
 )
 
+const (
+	MovieStatusDraft         = "draft"
+	MovieStatusPendingReview = "pending_review"
+	MovieStatusPublished     = "published"
+	MovieStatusArchived      = "archived"
+)
+
+var ErrInvalidStatusTransition = errors.New("invalid status transition")
+
+// MovieFilterFields whitelists the fields usable in a movies filter expression.
+var MovieFilterFields = filter.Fields{
+	"id":      {Column: "id", Type: filter.TypeBigInt},
+	"title":   {Column: "title", Type: filter.TypeString},
+	"year":    {Column: "year", Type: filter.TypeInt},
+	"runtime": {Column: "runtime", Type: filter.TypeInt},
+	"genres":  {Column: "genres", Type: filter.TypeStringArray},
+	"status":  {Column: "status", Type: filter.TypeString},
+}
+
+// movieStatusTransitions lists, for every status, the statuses a movie may move to.
+var movieStatusTransitions = map[string][]string{
+	MovieStatusDraft:         {MovieStatusPendingReview},
+	MovieStatusPendingReview: {MovieStatusPublished, MovieStatusDraft},
+	MovieStatusPublished:     {MovieStatusArchived},
+	MovieStatusArchived:      {MovieStatusPublished},
+}
+
 type Movie struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	CreatedAt time.Time `json:"created_at"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID           int64     `json:"id"`
+	Title        string    `json:"title"`
+	CreatedAt    time.Time `json:"created_at"`
+	Year         int32     `json:"year,omitempty"`
+	Runtime      Runtime   `json:"runtime,omitempty"`
+	Genres       []string  `json:"genres,omitempty"`
+	Status       string    `json:"status"`
+	SubmittedBy  int64     `json:"submitted_by,omitempty"`
+	ReviewReason string    `json:"review_reason,omitempty"`
+	Version      int32     `json:"version"`
+}
+
+// TransitionTo moves the movie to status, or returns ErrInvalidStatusTransition
+// when the workflow doesn't allow it.
+func (m *Movie) TransitionTo(status string) error {
+	if !validator.PermittdValue(status, movieStatusTransitions[m.Status]...) {
+		return ErrInvalidStatusTransition
+	}
+	m.Status = status
+	return nil
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -41,24 +83,30 @@ type MovieModel struct {
 
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		values ($1,$2,$3,$4)
+		INSERT INTO movies (title, year, runtime, genres, status, submitted_by)
+		values ($1,$2,$3,$4,$5,NULLIF($6, 0))
 		RETURNING id, created_at, version`
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	if movie.Status == "" {
+		movie.Status = MovieStatusDraft
+	}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Status, movie.SubmittedBy}
 	return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// Get returns the movie with the given id. Unless includeUnpublished is set,
+// movies that are not published are reported as not found.
+func (m MovieModel) Get(id int64, includeUnpublished bool) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
+	SELECT id, created_at, title, year, runtime, genres, status, COALESCE(submitted_by, 0), review_reason, version
 	FROM movies
-	WHERE id = $1`
+	WHERE id = $1 AND (status = 'published' OR $2)`
 	var movie Movie
-	err := m.DB.QueryRow(query, id).Scan(&movie.ID,
-		&movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+	err := m.DB.QueryRow(query, id, includeUnpublished).Scan(&movie.ID,
+		&movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres),
+		&movie.Status, &movie.SubmittedBy, &movie.ReviewReason, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -70,19 +118,24 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(title string, genres []string, collectionID int64, includeUnpublished bool, filters Filters) ([]*Movie, Metadata, error) {
+	expression, expressionArgs := filters.expression(MovieFilterFields, 7)
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, status, COALESCE(submitted_by, 0), review_reason, version
 		FROM movies
 		WHERE (LOWER(title) = LOWER($1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
+		AND ($3 = 0 OR id IN (SELECT movie_id FROM collections_movies WHERE collection_id = $3))
+		AND (status = 'published' OR $4)
+		AND %s
 		ORDER by %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumns(), filters.sortDirection())
+		LIMIT $5 OFFSET $6`, expression, filters.sortColumns(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), collectionID, includeUnpublished, filters.limit(), filters.offset()}
+	args = append(args, expressionArgs...)
 	result, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -100,6 +153,9 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Status,
+			&movie.SubmittedBy,
+			&movie.ReviewReason,
 			&movie.Version,
 		)
 		if err != nil {
@@ -114,14 +170,61 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// Suggest returns published movies whose title starts with, or closely
+// resembles, prefix. It runs under a short timeout since it backs a typeahead.
+func (m MovieModel) Suggest(prefix string, limit int, timeout time.Duration) ([]*MovieSuggestion, error) {
+	query := `
+		SELECT id, title, year
+		FROM movies
+		WHERE status = 'published'
+		AND (LOWER(title) LIKE $1 || '%' ESCAPE '\' OR LOWER(title) % $2)
+		ORDER BY similarity(LOWER(title), $2) DESC, id ASC
+		LIMIT $3`
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	prefix = strings.ToLower(prefix)
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	rows, err := m.DB.QueryContext(ctx, query, escaped, prefix, limit)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*MovieSuggestion{}
+	for rows.Next() {
+		var suggestion MovieSuggestion
+		if err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return suggestions, nil
+}
+
 func (m MovieModel) Update(movie *Movie) error {
 	query := `
 			UPDATE movies
-			SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-			WHERE id = $5 and version = $6
+			SET title = $1, year = $2, runtime = $3, genres = $4, status = $5, review_reason = $6, version = version + 1
+			WHERE id = $7 and version = $8
 			RETURNING version`
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Status, movie.ReviewReason, movie.ID, movie.Version}
 	err := m.DB.QueryRow(query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
@@ -161,14 +264,18 @@ func (m MockMovieModel) Insert(movie *Movie) error {
 	return nil
 }
 
-func (m MockMovieModel) Get(id int64) (*Movie, error) {
+func (m MockMovieModel) Get(id int64, includeUnpublished bool) (*Movie, error) {
 	return nil, nil
 }
 
-func (m MockMovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MockMovieModel) GetAll(title string, genres []string, collectionID int64, includeUnpublished bool, filters Filters) ([]*Movie, Metadata, error) {
 	return nil, Metadata{}, nil
 }
 
+func (m MockMovieModel) Suggest(prefix string, limit int, timeout time.Duration) ([]*MovieSuggestion, error) {
+	return nil, nil
+}
+
 func (m MockMovieModel) Update(movie *Movie) error {
 	return nil
 }
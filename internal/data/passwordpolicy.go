@@ -0,0 +1,199 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/v3ronez/IDKN/internal/validator"
+)
+
+// PasswordPolicy is what a new password has to satisfy on top of fitting the
+// hasher.
+type PasswordPolicy struct {
+	MinLength int
+	// MinScore is the lowest passwordScore accepted, from 0 to 4.
+	MinScore int
+	// RejectPersonal refuses passwords containing the user's name or the
+	// local part of their email address.
+	RejectPersonal bool
+	// Breached is checked when not nil.
+	Breached *BreachedList
+}
+
+var passwordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MinScore:       2,
+	RejectPersonal: true,
+	Breached:       DefaultBreachedList(),
+}
+
+// SetPasswordPolicy replaces the policy new passwords are validated with.
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// checkPasswordPolicy adds the policy failures for plainText, personal being
+// the name and email of the user it's for.
+func checkPasswordPolicy(v *validator.Validator, plainText string, personal ...string) {
+	policy := passwordPolicy
+	v.Check(len(plainText) >= policy.MinLength, "password", fmt.Sprintf("must be at least %d bytes long", policy.MinLength))
+	if policy.RejectPersonal {
+		v.Check(!containsPersonal(plainText, personal), "password", "must not contain your name or email address")
+	}
+	if policy.Breached != nil {
+		v.Check(!policy.Breached.Contains(plainText), "password", "has appeared in a data breach, choose another one")
+	}
+	v.Check(passwordScore(plainText) >= policy.MinScore, "password", "is too easy to guess, use a longer password or mix letters, numbers and symbols")
+}
+
+// containsPersonal reports whether the password contains, ignoring case, a
+// word of at least 3 letters from the user's name or email local part.
+func containsPersonal(plainText string, personal []string) bool {
+	lower := strings.ToLower(plainText)
+	for _, value := range personal {
+		value, _, _ = strings.Cut(strings.ToLower(value), "@")
+		words := strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if len(word) >= 3 && strings.Contains(lower, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passwordScore rates a password from 0 (trivial) to 4 (strong) from an
+// estimate of its entropy: the bits per character of the character classes
+// it uses, counted only for characters that don't repeat or continue a
+// sequence with the previous one.
+func passwordScore(plainText string) int {
+	var lower, upper, digit, symbol, other bool
+	effective := 0
+	var prev rune
+	for i, r := range plainText {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+		if i == 0 || (r != prev && r != prev+1 && r != prev-1) {
+			effective++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := float64(effective) * math.Log2(float64(pool))
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 40:
+		return 1
+	case bits < 55:
+		return 2
+	case bits < 70:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// BreachedList looks passwords up in a list of SHA-1 hashes of breached
+// passwords, split in ranges by the first 5 hex characters of the hash like
+// the Pwned Passwords range API. Only the range of the password's prefix is
+// read, so the full list can stay on disk.
+type BreachedList struct {
+	// rangeFor returns the range for a prefix, as lines of the remaining 35
+	// hex characters optionally followed by ":count".
+	rangeFor func(prefix string) ([]byte, error)
+}
+
+//go:embed breached_passwords.txt
+var shippedBreachedPasswords []byte
+
+// DefaultBreachedList is the short list of the most common passwords
+// shipped with the application.
+func DefaultBreachedList() *BreachedList {
+	ranges := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(shippedBreachedPasswords))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 40 {
+			continue
+		}
+		ranges[line[:5]] = append(ranges[line[:5]], line[5:]+"\n"...)
+	}
+	return &BreachedList{rangeFor: func(prefix string) ([]byte, error) {
+		return ranges[prefix], nil
+	}}
+}
+
+// NewBreachedListDir reads ranges from dir, one file per prefix named
+// <PREFIX>.txt, the layout the Pwned Passwords downloader writes.
+func NewBreachedListDir(dir string) (*BreachedList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &BreachedList{rangeFor: func(prefix string) ([]byte, error) {
+		b, err := os.ReadFile(filepath.Join(dir, prefix+".txt"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return b, err
+	}}, nil
+}
+
+// Contains reports whether the password is in the list. A range that can't
+// be read counts as not containing it, the other rules still apply.
+func (l *BreachedList) Contains(plainText string) bool {
+	sum := sha1.Sum([]byte(plainText))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	body, err := l.rangeFor(hash[:5])
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		suffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(suffix, hash[5:]) {
+			return true
+		}
+	}
+	return false
+}
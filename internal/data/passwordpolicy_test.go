@@ -0,0 +1,110 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordScore(t *testing.T) {
+	// no two neighbouring letters repeat or follow each other, each one
+	// counts for log2(26) = 4.7 bits.
+	const letters = "zqxjwkvmbpfhdtr"
+	tests := []struct {
+		plainText string
+		want      int
+	}{
+		{"", 0},
+		{"aaaaaaaaaaaaaaaaaaaa", 0},
+		{"abcdefghijklmnopqrst", 0},
+		{"9876543210", 0},
+		{letters[:5], 0},  // 23.5 bits
+		{letters[:6], 1},  // 28.2 bits
+		{letters[:8], 1},  // 37.6 bits
+		{letters[:9], 2},  // 42.3 bits
+		{letters[:11], 2}, // 51.7 bits
+		{letters[:12], 3}, // 56.4 bits
+		{letters[:14], 3}, // 65.8 bits
+		{letters[:15], 4}, // 70.5 bits
+		// all four classes give 6.6 bits a character.
+		{"Zq9!", 1},
+		{"Zq9!Xk2#", 2},
+		{"Zq9!Xk2#Lm", 3},
+		{"aaaaaaaaZq9!", 1},
+	}
+	for _, tt := range tests {
+		if got := passwordScore(tt.plainText); got != tt.want {
+			t.Errorf("passwordScore(%q) = %d, want %d", tt.plainText, got, tt.want)
+		}
+	}
+}
+
+func TestContainsPersonal(t *testing.T) {
+	personal := []string{"Ana Li", "John.Smith@example.com"}
+	tests := []struct {
+		plainText string
+		want      bool
+	}{
+		{"bananas and more", true},
+		{"SMITH-2024", true},
+		{"xjohnx", true},
+		// words shorter than 3 letters and the email domain don't count.
+		{"lilies in a vase", false},
+		{"example of a password", false},
+		{"nothing personal", false},
+	}
+	for _, tt := range tests {
+		if got := containsPersonal(tt.plainText, personal); got != tt.want {
+			t.Errorf("containsPersonal(%q) = %v, want %v", tt.plainText, got, tt.want)
+		}
+	}
+	if containsPersonal("anything", nil) {
+		t.Error("matched without personal values")
+	}
+}
+
+func TestDefaultBreachedList(t *testing.T) {
+	list := DefaultBreachedList()
+	for _, plainText := range []string{"password", "password1", "12345678", "iloveyou"} {
+		if !list.Contains(plainText) {
+			t.Errorf("%q not found in the shipped list", plainText)
+		}
+	}
+	for _, plainText := range []string{"xq7!Lm2#vZ", "correct horse battery staple", ""} {
+		if list.Contains(plainText) {
+			t.Errorf("%q found in the shipped list", plainText)
+		}
+	}
+}
+
+func TestBreachedListDir(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	dir := t.TempDir()
+	// suffixes are matched whatever their case, counts are ignored.
+	body := "0000000000000000000000000000000000A:3\r\n" + strings.ToLower(hash[5:]) + ":12\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := NewBreachedListDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains("hunter2hunter2") {
+		t.Error("password in its range file not found")
+	}
+	if list.Contains("hunter3hunter3") {
+		t.Error("password without a range file found")
+	}
+
+	if _, err = NewBreachedListDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("accepted a missing directory")
+	}
+	if _, err = NewBreachedListDir(filepath.Join(dir, hash[:5]+".txt")); err == nil {
+		t.Error("accepted a file as the directory")
+	}
+}
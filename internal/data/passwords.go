@@ -0,0 +1,160 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes new passwords. Stored hashes are verified by their
+// format whatever the hasher, so switching hashers or parameters only
+// affects passwords set afterwards.
+type PasswordHasher interface {
+	Hash(plainText string) ([]byte, error)
+	// Current reports whether hash was made by this hasher with its current
+	// parameters.
+	Current(hash []byte) bool
+	// MaxLength is the longest password the hasher takes into account.
+	MaxLength() int
+}
+
+// Argon2idParams are the argon2id cost parameters, Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher writes hashes as PHC strings:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2idHasher struct {
+	Params Argon2idParams
+}
+
+func (h Argon2idHasher) Hash(plainText string) ([]byte, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(plainText), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Params.Memory,
+		h.Params.Iterations,
+		h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h Argon2idHasher) Current(hash []byte) bool {
+	params, _, _, err := decodeArgon2id(hash)
+	return err == nil && params == h.Params
+}
+
+// MaxLength only guards against hashing huge inputs, argon2id itself reads
+// the whole password.
+func (h Argon2idHasher) MaxLength() int {
+	return 1024
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plainText string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plainText), h.Cost)
+}
+
+func (h BcryptHasher) Current(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost == h.Cost
+}
+
+// MaxLength is where bcrypt silently truncates.
+func (h BcryptHasher) MaxLength() int {
+	return 72
+}
+
+var passwordHasher PasswordHasher = Argon2idHasher{Params: DefaultArgon2idParams}
+
+// SetPasswordHasher replaces the hasher used for new passwords. It must be
+// called before any password is hashed.
+func SetPasswordHasher(h PasswordHasher) error {
+	hash, err := h.Hash(dummyPassword)
+	if err != nil {
+		return err
+	}
+	passwordHasher = h
+	dummyHashOnce = sync.Once{}
+	dummyHashOnce.Do(func() { dummyHash = hash })
+	return nil
+}
+
+// comparePasswordHash checks plainText against a hash of any format the
+// application ever wrote.
+func comparePasswordHash(hash []byte, plainText string) (bool, error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(plainText), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case bytes.HasPrefix(hash, []byte("$2")):
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plainText))
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+func decodeArgon2id(hash []byte) (params Argon2idParams, salt, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idParams keeps the tests fast, they are far below what
+// production uses.
+var testArgon2idParams = Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	h := Argon2idHasher{Params: testArgon2idParams}
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(hash, []byte("$argon2id$v=19$m=64,t=1,p=1$")) {
+		t.Errorf("hash %s is not a PHC string with the hasher's parameters", hash)
+	}
+	params, _, _, err := decodeArgon2id(hash)
+	if err != nil || params != testArgon2idParams {
+		t.Errorf("decoded %+v, %v; want %+v", params, err, testArgon2idParams)
+	}
+
+	for plainText, want := range map[string]bool{"correct horse": true, "correct horsf": false, "": false} {
+		match, err := comparePasswordHash(hash, plainText)
+		if err != nil || match != want {
+			t.Errorf("compare %q: got %v, %v; want %v", plainText, match, err, want)
+		}
+	}
+
+	other, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash, other) {
+		t.Error("two hashes of the same password are equal, the salt isn't random")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	h := Argon2idHasher{Params: testArgon2idParams}
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := testArgon2idParams
+	changed.Iterations = 2
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   []byte
+		want   bool
+	}{
+		{"same parameters", h, hash, true},
+		{"more iterations", Argon2idHasher{Params: changed}, hash, false},
+		{"argon2id hash, bcrypt hasher", BcryptHasher{Cost: bcrypt.MinCost}, hash, false},
+		{"same cost", BcryptHasher{Cost: bcrypt.MinCost}, bcryptHash, true},
+		{"higher cost", BcryptHasher{Cost: bcrypt.MinCost + 1}, bcryptHash, false},
+		{"bcrypt hash, argon2id hasher", h, bcryptHash, false},
+		{"malformed", h, []byte("$argon2id$"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.Current(tt.hash); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBcryptVerify(t *testing.T) {
+	// hashes written before argon2id was the default must still log in.
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for plainText, want := range map[string]bool{"correct horse": true, "Correct horse": false} {
+		match, err := comparePasswordHash(hash, plainText)
+		if err != nil || match != want {
+			t.Errorf("compare %q: got %v, %v; want %v", plainText, match, err, want)
+		}
+	}
+}
+
+func TestMalformedHash(t *testing.T) {
+	valid, err := Argon2idHasher{Params: testArgon2idParams}.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := bytes.Split(valid, []byte("$"))
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plain text", "correct horse"},
+		{"unknown algorithm", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5"},
+		{"missing part", "$argon2id$v=19$m=64,t=1,p=1$" + string(parts[4])},
+		{"other version", "$argon2id$v=16$m=64,t=1,p=1$" + string(parts[4]) + "$" + string(parts[5])},
+		{"bad parameters", "$argon2id$v=19$m=x,t=1,p=1$" + string(parts[4]) + "$" + string(parts[5])},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!$" + string(parts[5])},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$" + string(parts[4]) + "$!!"},
+		{"truncated bcrypt", "$2a$04$short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := comparePasswordHash([]byte(tt.hash), "correct horse")
+			if err == nil || match {
+				t.Errorf("got %v, %v; want an error", match, err)
+			}
+		})
+	}
+
+	if _, err = comparePasswordHash([]byte("plain"), "plain"); !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("got %v, want ErrUnknownHash", err)
+	}
+}
+
+func TestSetPasswordHasher(t *testing.T) {
+	previous := passwordHasher
+	t.Cleanup(func() { SetPasswordHasher(previous) })
+
+	h := BcryptHasher{Cost: bcrypt.MinCost}
+	if err := SetPasswordHasher(h); err != nil {
+		t.Fatal(err)
+	}
+	var p password
+	if err := p.Set("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Current(p.hash) || p.NeedsRehash() {
+		t.Errorf("new password hashed as %s, not by the hasher set", p.hash)
+	}
+	if !h.Current(dummyHash) {
+		t.Error("the dummy hash wasn't made by the hasher set")
+	}
+	CompareDummyPassword("correct horse")
+}
@@ -3,33 +3,121 @@ package data
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+// The permission codes the application checks. They are declared here, with
+// PermissionRegistry, and nowhere else.
+const (
+	PermissionMovieRead       = "movie:read"
+	PermissionMovieCreate     = "movie:create"
+	PermissionMoviePublish    = "movie:publish"
+	PermissionCollectionWrite = "collection:write"
+	PermissionStatsRead       = "stats:read"
+	PermissionUsersAdmin      = "users:admin"
+
+	// Wildcards, granted like any other code, cover every code matching them.
+	PermissionAll      = "*"
+	PermissionMovieAll = "movie:*"
+)
+
+type PermissionDefinition struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// PermissionRegistry describes every permission code. The permissions table
+// is checked against it at startup.
+var PermissionRegistry = []PermissionDefinition{
+	{PermissionMovieRead, "Browse and search the published catalogue"},
+	{PermissionMovieCreate, "Create movies and submit them for review"},
+	{PermissionMoviePublish, "Review, publish and archive movies"},
+	{PermissionCollectionWrite, "Create, edit and delete collections"},
+	{PermissionStatsRead, "Read catalogue statistics"},
+	{PermissionUsersAdmin, "Manage users, their permissions and roles"},
+	{PermissionAll, "Every permission"},
+	{PermissionMovieAll, "Every movie permission"},
+}
+
+// PermissionImplications lists, for a code, the codes holding it implies.
+// Implications are followed transitively.
+var PermissionImplications = map[string][]string{
+	PermissionMovieCreate:     {PermissionMovieRead},
+	PermissionMoviePublish:    {PermissionMovieRead},
+	PermissionCollectionWrite: {PermissionMovieRead},
+}
+
 type PermissionModel struct {
 	DB *sql.DB
 }
 
 type Permissions []string
 
+// Includes reports whether the permissions grant code, either directly,
+// through a wildcard or through PermissionImplications.
 func (p Permissions) Includes(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if grants(p[i], code, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func grants(granted, code string, depth int) bool {
+	if matchPermission(granted, code) {
+		return true
+	}
+	// implications are declared by hand, a cycle must not hang a request.
+	if depth >= 8 {
+		return false
+	}
+	for _, implied := range PermissionImplications[granted] {
+		if grants(implied, code, depth+1) {
 			return true
 		}
 	}
 	return false
 }
 
+// matchPermission matches code against pattern segment by segment, the
+// segments being separated by ":". A "*" segment matches any one segment, or
+// every remaining segment when it comes last. Segments of code are taken
+// literally: "movie:*" is only matched by "movie:*" or a broader wildcard.
+func matchPermission(pattern, code string) bool {
+	if pattern == code {
+		return true
+	}
+	patternSegments := strings.Split(pattern, ":")
+	codeSegments := strings.Split(code, ":")
+	for i, segment := range patternSegments {
+		if segment == "*" && i == len(patternSegments)-1 {
+			return len(codeSegments) > i
+		}
+		if i >= len(codeSegments) || (segment != "*" && segment != codeSegments[i]) {
+			return false
+		}
+	}
+	return len(patternSegments) == len(codeSegments)
+}
+
+// GetAllForUser returns the permissions granted to the user directly and
+// through their roles.
 func (pm PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users.id = users_permissions.user_id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -78,10 +166,43 @@ func (pm PermissionModel) GetAll() (Permissions, error) {
 	return permissions, nil
 }
 
+// Sync inserts the definitions missing from the permissions table and
+// refreshes the descriptions of the others.
+func (pm PermissionModel) Sync(definitions []PermissionDefinition) error {
+	query := `
+		INSERT INTO permissions (code, description)
+		VALUES ($1, $2)
+		ON CONFLICT (code) DO UPDATE SET description = EXCLUDED.description`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := pm.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, definition := range definitions {
+		if _, err = tx.ExecContext(ctx, query, definition.Code, definition.Description); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (pm PermissionModel) AddForUser(userID int64, permissions ...string) error {
 	query := `
 		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := pm.DB.ExecContext(ctx, query, userID, pq.Array(permissions))
+	return err
+}
+
+func (pm PermissionModel) RemoveForUser(userID int64, permissions ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		WHERE user_id = $1 AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($2))`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := pm.DB.ExecContext(ctx, query, userID, pq.Array(permissions))
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// routeCodes returns the permission codes the API checks, read from the
+// data.Permission constants referenced in cmd/api.
+func routeCodes(t *testing.T) []string {
+	t.Helper()
+	fset := token.NewFileSet()
+	permissions, err := parser.ParseFile(fset, "permissions.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constants := map[string]string{}
+	ast.Inspect(permissions, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok || len(spec.Values) != len(spec.Names) {
+			return true
+		}
+		for i, name := range spec.Names {
+			if lit, ok := spec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				constants[name.Name], _ = strconv.Unquote(lit.Value)
+			}
+		}
+		return true
+	})
+
+	packages, err := parser.ParseDir(fset, "../../cmd/api", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := map[string]bool{}
+	for _, pkg := range packages {
+		ast.Inspect(pkg, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "data" {
+				if code, ok := constants[sel.Sel.Name]; ok && strings.HasPrefix(sel.Sel.Name, "Permission") {
+					used[code] = true
+				}
+			}
+			return true
+		})
+	}
+	if len(used) == 0 {
+		t.Fatal("no permission code found in cmd/api")
+	}
+	codes := make([]string, 0, len(used))
+	for code := range used {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestPermissionsIncludes(t *testing.T) {
+	routeCodes := routeCodes(t)
+	tests := []struct {
+		name    string
+		granted Permissions
+		allowed []string
+	}{
+		{"nothing", Permissions{}, nil},
+		{"movie:read", Permissions{PermissionMovieRead}, []string{PermissionMovieRead}},
+		{"movie:create implies movie:read", Permissions{PermissionMovieCreate}, []string{PermissionMovieRead, PermissionMovieCreate}},
+		{"movie:publish implies movie:read", Permissions{PermissionMoviePublish}, []string{PermissionMovieRead, PermissionMoviePublish}},
+		{"collection:write implies movie:read", Permissions{PermissionCollectionWrite}, []string{PermissionMovieRead, PermissionCollectionWrite}},
+		{"stats:read", Permissions{PermissionStatsRead}, []string{PermissionStatsRead}},
+		{"users:admin", Permissions{PermissionUsersAdmin}, []string{PermissionUsersAdmin}},
+		{"everything", Permissions{PermissionAll}, routeCodes},
+		{"movie wildcard", Permissions{PermissionMovieAll}, []string{PermissionMovieRead, PermissionMovieCreate, PermissionMoviePublish}},
+		{"combined", Permissions{PermissionStatsRead, PermissionMovieAll}, []string{PermissionMovieRead, PermissionMovieCreate, PermissionMoviePublish, PermissionStatsRead}},
+		{"prefix only", Permissions{"movie"}, nil},
+		{"longer code", Permissions{"movie:read:own"}, nil},
+		{"unknown code", Permissions{"movies:read"}, nil},
+	}
+
+	// a code the API starts checking needs a case granting it.
+	for _, code := range routeCodes {
+		covered := false
+		for _, tt := range tests {
+			covered = covered || (len(tt.granted) == 1 && tt.granted[0] == code)
+		}
+		if !covered {
+			t.Errorf("no case grants %q alone", code)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, code := range routeCodes {
+				want := false
+				for _, allowed := range tt.allowed {
+					want = want || allowed == code
+				}
+				if got := tt.granted.Includes(code); got != want {
+					t.Errorf("%v.Includes(%q) = %t, want %t", tt.granted, code, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionsIncludesWildcardCode(t *testing.T) {
+	tests := []struct {
+		granted Permissions
+		code    string
+		want    bool
+	}{
+		{Permissions{PermissionAll}, PermissionMovieAll, true},
+		{Permissions{PermissionAll}, PermissionAll, true},
+		{Permissions{PermissionMovieAll}, PermissionMovieAll, true},
+		{Permissions{PermissionMovieAll}, PermissionAll, false},
+		{Permissions{PermissionMovieRead}, PermissionMovieAll, false},
+		{Permissions{PermissionMovieCreate}, PermissionMovieAll, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.granted.Includes(tt.code); got != tt.want {
+			t.Errorf("%v.Includes(%q) = %t, want %t", tt.granted, tt.code, got, tt.want)
+		}
+	}
+}
+
+// TestMatchPermission covers wildcards the registry doesn't declare, which
+// can't be granted but must still match like the others.
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		pattern, code string
+		want          bool
+	}{
+		{"users:*", PermissionUsersAdmin, true},
+		{"users:*", PermissionMovieRead, false},
+		{"*:read", PermissionMovieRead, true},
+		{"*:read", PermissionStatsRead, true},
+		{"*:read", PermissionMovieCreate, false},
+		{"*:read", "read", false},
+	}
+	for _, tt := range tests {
+		if got := matchPermission(tt.pattern, tt.code); got != tt.want {
+			t.Errorf("matchPermission(%q, %q) = %t, want %t", tt.pattern, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionsIncludesImplicationCycle(t *testing.T) {
+	saved := PermissionImplications
+	defer func() { PermissionImplications = saved }()
+	PermissionImplications = map[string][]string{
+		"a:one": {"a:two"},
+		"a:two": {"a:one"},
+	}
+
+	if !(Permissions{"a:one"}).Includes("a:two") {
+		t.Error(`"a:one" should include "a:two"`)
+	}
+	if (Permissions{"a:one"}).Includes("a:three") {
+		t.Error(`"a:one" should not include "a:three"`)
+	}
+}
+
+func TestRegistryCoversRouteCodes(t *testing.T) {
+	registered := Permissions{}
+	for _, definition := range PermissionRegistry {
+		registered = append(registered, definition.Code)
+	}
+	for _, code := range routeCodes(t) {
+		found := false
+		for _, r := range registered {
+			found = found || r == code
+		}
+		if !found {
+			t.Errorf("%q is not in PermissionRegistry", code)
+		}
+	}
+}
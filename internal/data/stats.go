@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type CountBy struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type MovieStats struct {
+	Total           int       `json:"total"`
+	PerGenre        []CountBy `json:"per_genre"`
+	PerDecade       []CountBy `json:"per_decade"`
+	PerYear         []CountBy `json:"per_year"`
+	AverageRuntime  float64   `json:"average_runtime"`
+	MedianRuntime   float64   `json:"median_runtime"`
+	NewestAdditions []*Movie  `json:"newest_additions"`
+	GeneratedAt     time.Time `json:"generated_at"`
+}
+
+type StatsModel struct {
+	DB *sql.DB
+}
+
+// Movies aggregates the published part of the catalogue. newest limits how
+// many of the most recently added movies are returned.
+func (s StatsModel) Movies(newest int) (*MovieStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats := &MovieStats{GeneratedAt: time.Now()}
+
+	query := `
+		SELECT count(*), COALESCE(avg(runtime), 0),
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY runtime), 0)
+		FROM movies
+		WHERE status = 'published'`
+	err := s.DB.QueryRowContext(ctx, query).Scan(&stats.Total, &stats.AverageRuntime, &stats.MedianRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.PerGenre, err = s.countBy(ctx, `
+		SELECT genre, count(*)
+		FROM movies, unnest(genres) AS genre
+		WHERE status = 'published'
+		GROUP BY genre
+		ORDER BY count(*) DESC, genre ASC`)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.PerDecade, err = s.countBy(ctx, `
+		SELECT ((year / 10) * 10)::text || 's', count(*)
+		FROM movies
+		WHERE status = 'published'
+		GROUP BY year / 10
+		ORDER BY year / 10 ASC`)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.PerYear, err = s.countBy(ctx, `
+		SELECT year::text, count(*)
+		FROM movies
+		WHERE status = 'published'
+		GROUP BY year
+		ORDER BY year ASC`)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT id, created_at, title, year, runtime, genres, status, COALESCE(submitted_by, 0), review_reason, version
+		FROM movies
+		WHERE status = 'published'
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1`
+	rows, err := s.DB.QueryContext(ctx, query, newest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.NewestAdditions = []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Status,
+			&movie.SubmittedBy,
+			&movie.ReviewReason,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		stats.NewestAdditions = append(stats.NewestAdditions, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (s StatsModel) countBy(ctx context.Context, query string) ([]CountBy, error) {
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []CountBy{}
+	for rows.Next() {
+		var c CountBy
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestDB returns a connection to a fresh schema of the database named by
+// IDKN_TEST_DSN, with every migration applied, and drops the schema when the
+// test ends. Tests using it are skipped when IDKN_TEST_DSN isn't set.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("IDKN_TEST_DSN")
+	if dsn == "" {
+		t.Skip("IDKN_TEST_DSN not set")
+	}
+
+	randBytes := make([]byte, 6)
+	if _, err := rand.Read(randBytes); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(randBytes)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err = admin.Exec(`CREATE EXTENSION IF NOT EXISTS citext`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+		if _, err = db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// lib/pq passes unknown connection parameters on as run-time parameters.
+	separator := " "
+	if strings.Contains(dsn, "://") {
+		separator = "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+	}
+	db, err := sql.Open("postgres", dsn+separator+"search_path="+schema+",public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(migrations)
+	for _, path := range migrations {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(string(b)); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+	}
+	return db
+}
+
+// insertTestUser inserts an activated user with the given email.
+func insertTestUser(t *testing.T, models Models, email string) *User {
+	t.Helper()
+	user := &User{Name: "Test", Email: email, Activated: true}
+	if err := user.Password.Set("a password nobody uses"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/v3ronez/IDKN/internal/validator"
@@ -14,14 +15,39 @@ import (
 const (
 	ScopeActivation    = "activation"
 	ScopeAuthenticaton = "authentication"
+	ScopePasswordReset = "password-reset"
+	ScopeRefresh       = "refresh"
+	ScopeTwoFactor     = "two-factor"
+	ScopeEmailChange   = "email-change"
 )
 
+// ErrTokenReused is returned when a refresh token that was already rotated is
+// presented again. Its whole family has been revoked by then.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type Token struct {
 	PlainText string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+	// Family groups an access token with the chain of refresh tokens it
+	// came from, so they can be revoked together.
+	Family string `json:"-"`
+}
+
+// Session describes a login, the family of tokens issued from it, without
+// exposing any of them.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -46,31 +72,131 @@ type TokenModel struct {
 }
 
 func (t TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return t.NewForClient(userID, ttl, scope, "", "", "")
+}
+
+// NewForClient is New for tokens that belong to a session, recording the
+// session family and the client the token was issued to.
+func (t TokenModel) NewForClient(userID int64, ttl time.Duration, scope, family, ip, userAgent string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
 	err = t.Insert(token)
 	return token, err
 }
 
+// NewRefresh starts a new session: a fresh family holding one refresh token.
+func (t TokenModel) NewRefresh(userID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return nil, err
+	}
+	family := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes)
+	return t.NewForClient(userID, ttl, ScopeRefresh, family, ip, userAgent)
+}
+
 func ValidateTokenPlainText(v *validator.Validator, TokenPlainText string) {
 	v.Check(TokenPlainText != "", "token", "must be provided")
 	v.Check(len(TokenPlainText) == 26, "token", "must be 26 bytes long")
 }
 
 func (t TokenModel) Insert(token *Token) error {
-	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES($1,$2,$3,$4)`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(15*time.Second))
 	defer cancel()
-	_, err := t.DB.ExecContext(ctx, query, args...)
+	return insertToken(ctx, t.DB, token)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertToken(ctx context.Context, db execer, token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family)
+		VALUES($1,$2,$3,$4,$5,$6,$7)`
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family}
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Rotate exchanges a refresh token for a new one of the same family. The old
+// refresh token is kept, marked as rotated, until it expires: presenting it
+// again revokes the whole family and returns ErrTokenReused together with a
+// token carrying the UserID and Family that were revoked.
+func (t TokenModel) Rotate(refreshPlainText string, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	hash := sha256.Sum256([]byte(refreshPlainText))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := t.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer tx.Rollback()
+
+	query := `
+		UPDATE tokens SET rotated = true, last_used_at = NOW()
+		WHERE hash = $1 AND scope = $2 AND expiry > NOW() AND NOT rotated
+		RETURNING user_id, family`
+	var userID int64
+	var family string
+	err = tx.QueryRowContext(ctx, query, hash[:], ScopeRefresh).Scan(&userID, &family)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		query = `SELECT user_id, family FROM tokens WHERE hash = $1 AND scope = $2 AND rotated`
+		err = tx.QueryRowContext(ctx, query, hash[:], ScopeRefresh).Scan(&userID, &family)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case err != nil:
+			return nil, err
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &Token{UserID: userID, Family: family}, ErrTokenReused
+	}
+
+	refresh, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	refresh.Family = family
+	refresh.IP = ip
+	refresh.UserAgent = userAgent
+	if err = insertToken(ctx, tx, refresh); err != nil {
+		return nil, err
+	}
+	return refresh, tx.Commit()
+}
+
+// DeleteExpired deletes up to limit expired tokens and returns how many it
+// deleted. Expired refresh tokens are kept while their family still has a
+// live token, they identify the session.
+func (t TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		DELETE FROM tokens WHERE hash IN (
+			SELECT hash FROM tokens expired
+			WHERE expired.expiry <= NOW()
+			AND NOT (expired.scope = $1 AND EXISTS (
+				SELECT 1 FROM tokens live
+				WHERE live.family = expired.family AND live.family <> '' AND live.expiry > NOW()))
+			LIMIT $2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, err := t.DB.ExecContext(ctx, query, ScopeRefresh, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 func (t TokenModel) DeleteAllForUser(scope string, userID int64) error {
@@ -83,3 +209,185 @@ func (t TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	}
 	return nil
 }
+
+// Touch records that the token was just used and returns its family and
+// expiry. Writes are skipped when the previous one is less than a minute old.
+func (t TokenModel) Touch(tokenPlainText string) (string, time.Time, error) {
+	hash := sha256.Sum256([]byte(tokenPlainText))
+	query := `
+		WITH touched AS (
+			UPDATE tokens SET last_used_at = NOW()
+			WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		)
+		SELECT family, expiry FROM tokens WHERE hash = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var family string
+	var expiry time.Time
+	err := t.DB.QueryRowContext(ctx, query, hash[:]).Scan(&family, &expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", time.Time{}, ErrRecordNotFound
+		default:
+			return "", time.Time{}, err
+		}
+	}
+	return family, expiry, nil
+}
+
+func (t TokenModel) DeleteByPlainText(scope, tokenPlainText string) error {
+	hash := sha256.Sum256([]byte(tokenPlainText))
+	query := `DELETE FROM tokens WHERE scope = $1 AND hash = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := t.DB.ExecContext(ctx, query, scope, hash[:])
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// CountAttempt counts an attempt made with the token, before its outcome is
+// known. The attempt past the max'th deletes the token and, like a token that
+// doesn't exist, returns ErrRecordNotFound.
+func (t TokenModel) CountAttempt(scope, tokenPlainText string, max int) error {
+	hash := sha256.Sum256([]byte(tokenPlainText))
+	query := `
+		UPDATE tokens SET attempts = attempts + 1
+		WHERE scope = $1 AND hash = $2 AND expiry > NOW()
+		RETURNING attempts`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var attempts int
+	err := t.DB.QueryRowContext(ctx, query, scope, hash[:]).Scan(&attempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if attempts > max {
+		if err = t.DeleteByPlainText(scope, tokenPlainText); err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteFamily deletes every token, of any scope, of one of the user's
+// sessions.
+func (t TokenModel) DeleteFamily(userID int64, family string) error {
+	if family == "" {
+		return ErrRecordNotFound
+	}
+	query := `DELETE FROM tokens WHERE user_id = $1 AND family = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := t.DB.ExecContext(ctx, query, userID, family)
+	return err
+}
+
+// DeleteOtherFamilies deletes the authentication and refresh tokens of every
+// session of the user but keep, returning the families that were deleted.
+func (t TokenModel) DeleteOtherFamilies(userID int64, keep string) ([]string, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND family <> $2 AND scope IN ($3, $4)
+		RETURNING family`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := t.DB.QueryContext(ctx, query, userID, keep, ScopeAuthenticaton, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	families := []string{}
+	for rows.Next() {
+		var family string
+		if err := rows.Scan(&family); err != nil {
+			return nil, err
+		}
+		if family != "" && !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// GetSessionFamily returns the family of the user's session with the given id.
+func (t TokenModel) GetSessionFamily(userID, sessionID int64) (string, error) {
+	query := `SELECT family FROM tokens WHERE user_id = $1 AND id = $2 AND family <> ''`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var family string
+	err := t.DB.QueryRowContext(ctx, query, userID, sessionID).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return family, nil
+}
+
+// GetSessionsForUser lists the user's live sessions, one per token family
+// with an unused refresh token, flagging currentFamily. A session is
+// identified by the oldest token of its family.
+func (t TokenModel) GetSessionsForUser(userID int64, currentFamily string) ([]*Session, error) {
+	query := `
+		SELECT min(f.id), min(f.created_at), max(f.last_used_at), head.expiry, head.ip, head.user_agent, head.family = $3
+		FROM tokens head
+		INNER JOIN tokens f ON f.family = head.family
+		WHERE head.user_id = $1 AND head.scope = $2 AND NOT head.rotated AND head.expiry > NOW()
+		GROUP BY head.hash
+		ORDER BY min(f.created_at) DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, userID, ScopeRefresh, currentFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetSessionsForUser(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	user := insertTestUser(t, models, "sessions@example.com")
+	other := insertTestUser(t, models, "other@example.com")
+
+	first, err := models.Tokens.NewRefresh(user.ID, time.Hour, "192.0.2.1", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := models.Tokens.Rotate(first.PlainText, time.Hour, "192.0.2.2", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := models.Tokens.NewRefresh(user.ID, time.Hour, "192.0.2.3", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.Tokens.NewRefresh(other.ID, time.Hour, "192.0.2.4", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := models.Tokens.GetSessionsForUser(user.ID, rotated.Family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	byAgent := map[string]*Session{}
+	for _, s := range sessions {
+		byAgent[s.UserAgent] = s
+	}
+
+	current := byAgent["first"]
+	switch {
+	case current == nil:
+		t.Fatal("rotated session missing")
+	case !current.Current:
+		t.Error("rotated session not flagged current")
+	case current.IP != "192.0.2.2":
+		t.Errorf("rotated session IP = %q, want the latest token's", current.IP)
+	case current.LastUsedAt == nil:
+		t.Error("rotated session has no last use")
+	}
+	// the session keeps the id of its first token across rotations.
+	family, err := models.Tokens.GetSessionFamily(user.ID, current.ID)
+	if err != nil || family != first.Family {
+		t.Errorf("session %d family = %q, %v; want %q", current.ID, family, err, first.Family)
+	}
+
+	if s := byAgent["second"]; s == nil || s.Current {
+		t.Errorf("second session = %+v, want it listed and not current", s)
+	}
+	if second.Family == rotated.Family {
+		t.Error("new session reused a family")
+	}
+}
@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+	// ErrCodeReplayed is returned when a TOTP code, or an older one, is
+	// presented after a later code was accepted.
+	ErrCodeReplayed = errors.New("code already used")
+)
+
+type TwoFactor struct {
+	UserID    int64
+	CreatedAt time.Time
+	Secret    string
+	Enabled   bool
+	LastStep  int64
+}
+
+// GenerateRecoveryCodes returns n one-time codes, formatted as two groups of
+// five characters, and the hashes to store for them.
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+	for i := range codes {
+		randBytes := make([]byte, 10)
+		if _, err := rand.Read(randBytes); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `SELECT user_id, created_at, secret, enabled, last_step FROM two_factor WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.UserID, &tf.CreatedAt, &tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &tf, nil
+}
+
+// Enrol stores a new secret for the user, pending confirmation. Enrolling
+// again before confirming replaces the secret.
+func (m TwoFactorModel) Enrol(userID int64, secret string) error {
+	query := `
+		INSERT INTO two_factor (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+		WHERE NOT two_factor.enabled`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// Enable turns 2FA on once the first code was accepted at step, replacing the
+// user's recovery codes.
+func (m TwoFactorModel) Enable(userID, step int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE two_factor SET enabled = true, last_step = $2 WHERE user_id = $1 AND NOT enabled`
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, hash, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseStep records that a code of the given step was accepted. It fails with
+// ErrCodeReplayed unless step is later than every step accepted before, which
+// also settles two concurrent logins with the same code.
+func (m TwoFactorModel) UseStep(userID, step int64) error {
+	query := `UPDATE two_factor SET last_step = $2 WHERE user_id = $1 AND last_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCodeReplayed
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) error {
+	query := `DELETE FROM recovery_codes WHERE hash = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
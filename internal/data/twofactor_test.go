@@ -0,0 +1,56 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUseStep(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	user := insertTestUser(t, models, "totp@example.com")
+	if err := models.TwoFactor.Enrol(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.TwoFactor.Enable(user.ID, 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		step int64
+		want error
+	}{
+		{100, ErrCodeReplayed},
+		{99, ErrCodeReplayed},
+		{101, nil},
+		{101, ErrCodeReplayed},
+		{103, nil},
+		{102, ErrCodeReplayed},
+	}
+	for _, tt := range tests {
+		if err := models.TwoFactor.UseStep(user.ID, tt.step); !errors.Is(err, tt.want) {
+			t.Errorf("step %d: got %v, want %v", tt.step, err, tt.want)
+		}
+	}
+}
+
+func TestCountAttempt(t *testing.T) {
+	models := NewModels(newTestDB(t))
+	user := insertTestUser(t, models, "attempts@example.com")
+	token, err := models.Tokens.New(user.ID, time.Minute, ScopeTwoFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err = models.Tokens.CountAttempt(ScopeTwoFactor, token.PlainText, 3); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if err = models.Tokens.CountAttempt(ScopeTwoFactor, token.PlainText, 3); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("attempt 4: got %v, want ErrRecordNotFound", err)
+	}
+	if _, err = models.Users.GetForToken(ScopeTwoFactor, token.PlainText); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("token still usable after too many attempts: %v", err)
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/v3ronez/IDKN/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -32,7 +33,7 @@ type password struct {
 }
 
 func (p *password) Set(plainTextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plainTextPassword), 12)
+	hash, err := passwordHasher.Hash(plainTextPassword)
 	if err != nil {
 		return err
 	}
@@ -42,16 +43,33 @@ func (p *password) Set(plainTextPassword string) error {
 }
 
 func (p *password) Matches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return comparePasswordHash(p.hash, plainText)
+}
+
+// NeedsRehash reports whether the hash was made with another algorithm or
+// parameters than the ones new passwords get.
+func (p *password) NeedsRehash() bool {
+	return !passwordHasher.Current(p.hash)
+}
+
+// dummyHash is what a login naming no account is compared against, so it
+// takes as long to reject as a wrong password. Hashing is too slow to do
+// whenever the package is imported, it is made on first use or by
+// SetPasswordHasher.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+const dummyPassword = "not the password of any account"
+
+// CompareDummyPassword spends the time password.Matches would, for logins
+// that don't match any user.
+func CompareDummyPassword(plainText string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = passwordHasher.Hash(dummyPassword)
+	})
+	comparePasswordHash(dummyHash, plainText)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -59,10 +77,12 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidatePaswordPlainText(v *validator.Validator, plainTextPassword string) {
+// ValidatePaswordPlainText checks a new password against the password
+// policy. personal is the name and email of the user it's for, when known.
+func ValidatePaswordPlainText(v *validator.Validator, plainTextPassword string, personal ...string) {
 	v.Check(plainTextPassword != "", "password", "must be provided")
-	v.Check(len(plainTextPassword) >= 8, "password", "must at least 8 bytes long")
-	v.Check(len(plainTextPassword) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(plainTextPassword) <= passwordHasher.MaxLength(), "password", fmt.Sprintf("must not be more than %d bytes long", passwordHasher.MaxLength()))
+	checkPasswordPolicy(v, plainTextPassword, personal...)
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -71,7 +91,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plainText != nil {
-		ValidatePaswordPlainText(v, *user.Password.plainText)
+		ValidatePaswordPlainText(v, *user.Password.plainText, user.Name, user.Email)
 	}
 	if user.Password.hash == nil {
 		panic("missing password hash for user")
@@ -84,8 +104,8 @@ type UserModel struct {
 
 func (u UserModel) Insert(user *User) error {
 	query := `
-			INSERT INTO users (name, email, password_hash, activated)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO users (name, email, password_hash, activated, activated_at)
+			VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 			RETURNING id, created_at, version`
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -135,10 +155,93 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+func (u UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+			SELECT
+			id,
+			created_at,
+			name,
+			email,
+			password_hash,
+			activated,
+			version
+			FROM users WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	if err := u.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAll lists users whose name and email contain the given strings, an empty
+// string matching everyone.
+func (u UserModel) GetAll(name, email string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+		AND (email ILIKE '%%' || $2 || '%%' OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumns(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, name, email, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	totalRecords := 0
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
 func (u UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-	 	SET name = $1, email = $2,password_hash = $3,activated = $4, version = version + 1
+	 	SET name = $1, email = $2,password_hash = $3,activated = $4, version = version + 1,
+		activated_at = CASE WHEN $4 THEN COALESCE(activated_at, NOW()) ELSE activated_at END
 		WHERE id = $5 and version = $6
 		RETURNING version`
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
@@ -158,11 +261,143 @@ func (u UserModel) Update(user *User) error {
 	return nil
 }
 
+// ActivateNeverActivated activates an account that was never activated,
+// storing the user's password hash with it. It returns ErrEditConflict, and
+// changes nothing, when the account was activated at some point, as an
+// account an admin deactivated must stay so, or was edited since it was read.
+func (u UserModel) ActivateNeverActivated(user *User) error {
+	query := `
+		UPDATE users
+		SET activated = true, activated_at = NOW(), password_hash = $1, version = version + 1
+		WHERE id = $2 AND version = $3 AND activated_at IS NULL
+		RETURNING version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := u.DB.QueryRowContext(ctx, query, user.Password.hash, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	user.Activated = true
+	return nil
+}
+
+// Rehash stores a hash of the user's password made with the current hasher,
+// if theirs is outdated. plainText must already have been matched. The
+// version is left alone so it doesn't conflict with edits in flight, and
+// nothing is stored if the password changed since the user was read.
+func (u UserModel) Rehash(user *User, plainText string) error {
+	if !user.Password.NeedsRehash() {
+		return nil
+	}
+	hash, err := passwordHasher.Hash(plainText)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = u.DB.ExecContext(ctx, query, hash, user.ID, user.Password.hash)
+	return err
+}
+
+func (u UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `DELETE FROM users WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := u.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetUnwarnedStale returns, by ID from afterID, up to limit users who
+// registered before registeredBefore, were never activated and weren't warned
+// their account will be deleted.
+func (u UserModel) GetUnwarnedStale(registeredBefore time.Time, afterID int64, limit int) ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE activated_at IS NULL AND NOT activated AND deletion_warned_at IS NULL AND created_at < $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, registeredBefore, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+// MarkDeletionWarned records that the user was told their account will be
+// deleted.
+func (u UserModel) MarkDeletionWarned(id int64) error {
+	query := `UPDATE users SET deletion_warned_at = NOW() WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := u.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// DeleteStale deletes up to limit users who registered before
+// registeredBefore, were never activated and were warned before warnedBefore.
+// It returns how many it deleted.
+func (u UserModel) DeleteStale(registeredBefore, warnedBefore time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM users WHERE id IN (
+			SELECT id FROM users
+			WHERE activated_at IS NULL AND NOT activated AND created_at < $1 AND deletion_warned_at < $2
+			LIMIT $3)`
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, err := u.DB.ExecContext(ctx, query, registeredBefore, warnedBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func (u UserModel) GetForToken(scope, tokenPlainText string) (*User, error) {
 	t := sha256.Sum256([]byte(tokenPlainText))
 	query := `
 		SELECT
-			users.*
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
 		FROM users
 		INNER JOIN tokens ON tokens.user_id = users.id
 		WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3`
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type FieldType int
+
+const (
+	// TypeInt is a 32-bit integer column, Postgres' integer.
+	TypeInt FieldType = iota
+	TypeString
+	TypeStringArray
+	// TypeBigInt is a 64-bit integer column, Postgres' bigint.
+	TypeBigInt
+)
+
+// Field whitelists a filterable field and the SQL column it maps to.
+type Field struct {
+	Column string
+	Type   FieldType
+}
+
+// Fields maps the names accepted in expressions to their columns.
+type Fields map[string]Field
+
+var operatorsByType = map[FieldType][]string{
+	TypeInt:         {"=", "!=", "<", "<=", ">", ">="},
+	TypeBigInt:      {"=", "!=", "<", "<=", ">", ">="},
+	TypeString:      {"=", "!="},
+	TypeStringArray: {"has"},
+}
+
+// Check verifies that every comparison uses a whitelisted field, an operator
+// allowed for its type and a value of the right kind, in range for the
+// column, so the compiled query can't fail on it.
+func Check(node Node, fields Fields) error {
+	switch n := node.(type) {
+	case *Binary:
+		if err := Check(n.Left, fields); err != nil {
+			return err
+		}
+		return Check(n.Right, fields)
+
+	case *Not:
+		return Check(n.Expr, fields)
+
+	case *Comparison:
+		field, ok := fields[n.Field]
+		if !ok {
+			return errorf(n.pos, "unknown field %q", n.Field)
+		}
+		if !permitted(n.Op, operatorsByType[field.Type]) {
+			return errorf(n.opPos, "operator %q is not supported for field %q", n.Op, n.Field)
+		}
+		switch field.Type {
+		case TypeInt, TypeBigInt:
+			value, ok := n.Value.(int64)
+			if !ok {
+				return errorf(n.valuePos, "field %q must be compared with a number", n.Field)
+			}
+			if field.Type == TypeInt && (value < math.MinInt32 || value > math.MaxInt32) {
+				return errorf(n.valuePos, "number %d is out of range for field %q", value, n.Field)
+			}
+		case TypeString, TypeStringArray:
+			if _, ok := n.Value.(string); !ok {
+				return errorf(n.valuePos, "field %q must be compared with a string", n.Field)
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("filter: unexpected node %T", node)
+	}
+}
+
+// Compile turns a checked expression into a SQL condition. Values are never
+// written into the SQL, they are returned as args to be bound starting at the
+// placeholder $firstArg.
+func Compile(node Node, fields Fields, firstArg int) (string, []any) {
+	c := &compiler{fields: fields, next: firstArg}
+	var sb strings.Builder
+	c.compile(&sb, node)
+	return sb.String(), c.args
+}
+
+type compiler struct {
+	fields Fields
+	next   int
+	args   []any
+}
+
+func (c *compiler) placeholder(value any) string {
+	c.args = append(c.args, value)
+	p := fmt.Sprintf("$%d", c.next)
+	c.next++
+	return p
+}
+
+func (c *compiler) compile(sb *strings.Builder, node Node) {
+	switch n := node.(type) {
+	case *Binary:
+		sb.WriteString("(")
+		c.compile(sb, n.Left)
+		if n.Op == "and" {
+			sb.WriteString(" AND ")
+		} else {
+			sb.WriteString(" OR ")
+		}
+		c.compile(sb, n.Right)
+		sb.WriteString(")")
+
+	case *Not:
+		sb.WriteString("NOT (")
+		c.compile(sb, n.Expr)
+		sb.WriteString(")")
+
+	case *Comparison:
+		field := c.fields[n.Field]
+		switch {
+		case n.Op == "has":
+			fmt.Fprintf(sb, "%s = ANY(%s)", c.placeholder(n.Value), field.Column)
+		case field.Type == TypeString:
+			fmt.Fprintf(sb, "LOWER(%s) %s LOWER(%s)", field.Column, n.Op, c.placeholder(n.Value))
+		default:
+			fmt.Fprintf(sb, "%s %s %s", field.Column, n.Op, c.placeholder(n.Value))
+		}
+	}
+}
+
+func permitted(value string, list []string) bool {
+	for i := range list {
+		if value == list[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package filter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testFields = Fields{
+	"id":      {Column: "id", Type: TypeBigInt},
+	"title":   {Column: "title", Type: TypeString},
+	"year":    {Column: "year", Type: TypeInt},
+	"runtime": {Column: "runtime", Type: TypeInt},
+	"genres":  {Column: "genres", Type: TypeStringArray},
+}
+
+func compile(t *testing.T, input string, firstArg int) (string, []any) {
+	t.Helper()
+	node, err := Parse(input)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", input, err)
+	}
+	if err = Check(node, testFields); err != nil {
+		t.Fatalf("Check(%q): %v", input, err)
+	}
+	return Compile(node, testFields, firstArg)
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input string
+		sql   string
+		args  []any
+	}{
+		{`year = 2000`, `year = $1`, []any{int64(2000)}},
+		{`id >= -1`, `id >= $1`, []any{int64(-1)}},
+		{`title != "Heat"`, `LOWER(title) != LOWER($1)`, []any{"Heat"}},
+		{`genres has "drama"`, `$1 = ANY(genres)`, []any{"drama"}},
+		{`title = "say \"hi\""`, `LOWER(title) = LOWER($1)`, []any{`say "hi"`}},
+		// "and" binds tighter than "or", "not" tighter than both.
+		{
+			`year < 1 or year > 2 and runtime = 3`,
+			`(year < $1 OR (year > $2 AND runtime = $3))`,
+			[]any{int64(1), int64(2), int64(3)},
+		},
+		{
+			`(year < 1 or year > 2) and runtime = 3`,
+			`((year < $1 OR year > $2) AND runtime = $3)`,
+			[]any{int64(1), int64(2), int64(3)},
+		},
+		{
+			`not year = 1 and runtime = 2`,
+			`(NOT (year = $1) AND runtime = $2)`,
+			[]any{int64(1), int64(2)},
+		},
+		{
+			`not (year = 1 and runtime = 2)`,
+			`NOT ((year = $1 AND runtime = $2))`,
+			[]any{int64(1), int64(2)},
+		},
+		{
+			`year = 1 or year = 2 or year = 3`,
+			`((year = $1 OR year = $2) OR year = $3)`,
+			[]any{int64(1), int64(2), int64(3)},
+		},
+		{
+			`year = 1 AND Not runtime = 2`,
+			`(year = $1 AND NOT (runtime = $2))`,
+			[]any{int64(1), int64(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			sql, args := compile(t, tt.input, 1)
+			if sql != tt.sql {
+				t.Errorf("got %q, want %q", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("got args %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestCompileFirstArg(t *testing.T) {
+	sql, args := compile(t, `year = 1 and (title = "a" or genres has "b")`, 7)
+	want := `(year = $7 AND (LOWER(title) = LOWER($8) OR $9 = ANY(genres)))`
+	if sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+	if len(args) != 3 {
+		t.Errorf("got %d args, want 3", len(args))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+	}{
+		// lexer
+		{`year ! 1`, 6},
+		{`title = "open`, 9},
+		{`year = - 1`, 8},
+		{`year = 1 ; drop`, 10},
+		// parser
+		{``, 1},
+		{`year`, 5},
+		{`year = `, 8},
+		{`year = 1 and`, 13},
+		{`(year = 1`, 10},
+		{`year = 1)`, 9},
+		{`= 1`, 1},
+		{`year = title`, 8},
+		{`year = 99999999999999999999`, 8},
+		// checker
+		{`rating = 1`, 1},
+		{`YEAR = 1`, 1},
+		{`year = 1 and secret = "x"`, 14},
+		{`title < "a"`, 7},
+		{`genres = "drama"`, 8},
+		{`year has 1`, 6},
+		{`year = "2000"`, 8},
+		{`title = 1`, 9},
+		{`year = 2147483648`, 8},
+		{`runtime > -2147483649`, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			if err == nil {
+				err = Check(node, testFields)
+			}
+			var syntaxError *SyntaxError
+			if !errors.As(err, &syntaxError) {
+				t.Fatalf("got %v, want a *SyntaxError", err)
+			}
+			if syntaxError.Pos != tt.pos {
+				t.Errorf("got position %d (%s), want %d", syntaxError.Pos, syntaxError.Msg, tt.pos)
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	for _, input := range []string{`year = 2147483647`, `year = -2147483648`, `id = 9223372036854775807`} {
+		node, err := Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Check(node, testFields); err != nil {
+			t.Errorf("Check(%q): %v", input, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	nested := ""
+	for range maxDepth + 1 {
+		nested += "("
+	}
+	nested += "year = 1"
+	for range maxDepth + 1 {
+		nested += ")"
+	}
+	many := "year = 1"
+	for range maxComparisons {
+		many += " or year = 1"
+	}
+	long := "title = \""
+	for len(long) <= maxInputLength {
+		long += "a"
+	}
+	long += "\""
+
+	for _, input := range []string{nested, many, long} {
+		var syntaxError *SyntaxError
+		if _, err := Parse(input); !errors.As(err, &syntaxError) {
+			t.Errorf("Parse of a %d byte expression: got %v, want a *SyntaxError", len(input), err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of input"
+	case tokenIdent:
+		return "field"
+	case tokenNumber:
+		return "number"
+	case tokenString:
+		return "string"
+	case tokenOperator:
+		return "operator"
+	case tokenLParen:
+		return `"("`
+	case tokenRParen:
+		return `")"`
+	case tokenAnd:
+		return `"and"`
+	case tokenOr:
+		return `"or"`
+	case tokenNot:
+		return `"not"`
+	default:
+		return "token"
+	}
+}
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// SyntaxError reports a problem with a filter expression. Pos is the 1-based
+// byte offset of the offending token.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s (at position %d)", e.Msg, e.Pos)
+}
+
+func errorf(pos int, format string, args ...any) *SyntaxError {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+var keywords = map[string]tokenKind{
+	"and": tokenAnd,
+	"or":  tokenOr,
+	"not": tokenNot,
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, value: "(", pos: pos})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, value: ")", pos: pos})
+			i++
+
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenOperator, value: "=", pos: pos})
+			i++
+
+		case c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(input) && input[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, errorf(pos, `unexpected character "!", did you mean "!="`)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, value: op, pos: pos})
+			i += len(op)
+
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			closed := false
+			for j < len(input) {
+				if input[j] == '\\' && j+1 < len(input) {
+					sb.WriteByte(input[j+1])
+					j += 2
+					continue
+				}
+				if input[j] == '"' {
+					closed = true
+					break
+				}
+				sb.WriteByte(input[j])
+				j++
+			}
+			if !closed {
+				return nil, errorf(pos, "unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokenString, value: sb.String(), pos: pos})
+			i = j + 1
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(input) && input[j] >= '0' && input[j] <= '9' {
+				j++
+			}
+			if c == '-' && j == i+1 {
+				return nil, errorf(pos, `unexpected character "-"`)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: input[i:j], pos: pos})
+			i = j
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(input) && (input[j] == '_' || unicode.IsLetter(rune(input[j])) || (input[j] >= '0' && input[j] <= '9')) {
+				j++
+			}
+			word := input[i:j]
+			lower := strings.ToLower(word)
+			switch {
+			case lower == "has":
+				tokens = append(tokens, token{kind: tokenOperator, value: "has", pos: pos})
+			case keywords[lower] != 0:
+				tokens = append(tokens, token{kind: keywords[lower], value: lower, pos: pos})
+			default:
+				tokens = append(tokens, token{kind: tokenIdent, value: word, pos: pos})
+			}
+			i = j
+
+		default:
+			return nil, errorf(pos, "unexpected character %q", c)
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(input) + 1})
+	return tokens, nil
+}
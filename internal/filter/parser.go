@@ -0,0 +1,201 @@
+package filter
+
+import (
+	"strconv"
+)
+
+const (
+	maxInputLength = 1_000
+	maxComparisons = 32
+	maxDepth       = 16
+)
+
+// Node is an element of a parsed filter expression.
+type Node interface {
+	Pos() int
+}
+
+// Binary joins two expressions with "and" or "or".
+type Binary struct {
+	Op          string
+	Left, Right Node
+	pos         int
+}
+
+func (b *Binary) Pos() int { return b.pos }
+
+// Not negates an expression.
+type Not struct {
+	Expr Node
+	pos  int
+}
+
+func (n *Not) Pos() int { return n.pos }
+
+// Comparison compares a field with a literal value.
+type Comparison struct {
+	Field    string
+	Op       string
+	Value    any // int64 or string
+	pos      int
+	opPos    int
+	valuePos int
+}
+
+func (c *Comparison) Pos() int { return c.pos }
+
+type parser struct {
+	tokens      []token
+	current     int
+	depth       int
+	comparisons int
+}
+
+// Parse turns a filter expression such as
+//
+//	year>=2000 and (genres has "drama" or runtime<90)
+//
+// into an AST. Errors are returned as *SyntaxError.
+func Parse(input string) (Node, error) {
+	if len(input) > maxInputLength {
+		return nil, errorf(maxInputLength+1, "expression must not be more than %d bytes long", maxInputLength)
+	}
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorf(tok.pos, "unexpected %s %q", tok.kind, tok.value)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.current]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.current]
+	if tok.kind != tokenEOF {
+		p.current++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		op := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: "or", Left: left, Right: right, pos: op.pos}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		op := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: "and", Left: left, Right: right, pos: op.pos}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if p.peek().kind == tokenNot {
+		tok := p.next()
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr, pos: tok.pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, errorf(closing.pos, `expected ")" but found %s`, closing.kind)
+		}
+		return node, nil
+
+	case tokenIdent:
+		return p.parseComparison(tok)
+
+	default:
+		return nil, errorf(tok.pos, "expected a field or \"(\" but found %s", tok.kind)
+	}
+}
+
+func (p *parser) parseComparison(field token) (Node, error) {
+	p.comparisons++
+	if p.comparisons > maxComparisons {
+		return nil, errorf(field.pos, "expression must not contain more than %d comparisons", maxComparisons)
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, errorf(op.pos, "expected an operator after %q but found %s", field.value, op.kind)
+	}
+
+	value := p.next()
+	c := &Comparison{Field: field.value, Op: op.value, pos: field.pos, opPos: op.pos, valuePos: value.pos}
+	switch value.kind {
+	case tokenNumber:
+		n, err := strconv.ParseInt(value.value, 10, 64)
+		if err != nil {
+			return nil, errorf(value.pos, "invalid number %q", value.value)
+		}
+		c.Value = n
+	case tokenString:
+		c.Value = value.value
+	default:
+		return nil, errorf(value.pos, "expected a number or a string but found %s", value.kind)
+	}
+	return c, nil
+}
+
+func (p *parser) enter(tok token) error {
+	p.depth++
+	if p.depth > maxDepth {
+		return errorf(tok.pos, "expression must not be nested more than %d levels deep", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
@@ -0,0 +1,145 @@
+// Package jwt signs and verifies the HS256 JSON Web Tokens used by the
+// stateless authentication mode. Every token names the key it was signed with
+// in its "kid" header so keys can be rotated without invalidating tokens
+// signed with the previous one.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	ErrUnknownKey   = errors.New("jwt: unknown signing key")
+	ErrExpired      = errors.New("jwt: token expired")
+)
+
+type Claims struct {
+	ID        string   `json:"jti"`
+	Subject   int64    `json:"sub"`
+	Session   string   `json:"sid,omitempty"`
+	Scopes    []string `json:"scopes"`
+	Activated bool     `json:"activated"`
+	// IssuedAt has sub-second precision so tokens issued right after a
+	// revocation can be told from those issued right before it.
+	IssuedAt float64 `json:"iat"`
+	Expiry   int64   `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Keys holds every key tokens may be verified with and the one new tokens
+// are signed with.
+type Keys struct {
+	active string
+	keys   map[string][]byte
+}
+
+func NewKeys(activeID string, keys map[string][]byte) (*Keys, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, fmt.Errorf("jwt: active key %q is not configured", activeID)
+	}
+	for id, key := range keys {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("jwt: key %q must be at least 32 bytes long", id)
+		}
+	}
+	return &Keys{active: activeID, keys: keys}, nil
+}
+
+// ParseKeys reads keys written as "id:base64secret,id2:base64secret".
+func ParseKeys(spec string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(part, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("jwt: malformed key %q, expected id:base64secret", part)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %q is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+var encoding = base64.RawURLEncoding
+
+func (k *Keys) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: k.active})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return unsigned + "." + encoding.EncodeToString(sign(k.keys[k.active], unsigned)), nil
+}
+
+func (k *Keys) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if h.Algorithm != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	key, ok := k.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decode(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+func sign(key []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decode(part string, dest any) error {
+	b, err := encoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dest)
+}
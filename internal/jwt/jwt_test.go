@@ -0,0 +1,137 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte("1"), 32)
+	testKey2 = bytes.Repeat([]byte("2"), 32)
+)
+
+func newTestKeys(t *testing.T, active string) *Keys {
+	t.Helper()
+	keys, err := NewKeys(active, map[string][]byte{"k1": testKey1, "k2": testKey2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testClaims(now time.Time) Claims {
+	return Claims{
+		ID:        "jti",
+		Subject:   42,
+		Session:   "family",
+		Scopes:    []string{"movie:read"},
+		Activated: true,
+		IssuedAt:  float64(now.UnixMicro()) / 1e6,
+		Expiry:    now.Add(time.Minute).Unix(),
+	}
+}
+
+// resign replaces the token's header and signs it again with key.
+func resign(t *testing.T, token string, h header, key []byte) string {
+	t.Helper()
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rest, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(rest, ".")
+	unsigned := encoding.EncodeToString(b) + "." + payload
+	return unsigned + "." + encoding.EncodeToString(sign(key, unsigned))
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Now()
+	claims := testClaims(now)
+	token, err := newTestKeys(t, "k1").Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens signed with a previous key still verify after a rotation.
+	got, err := newTestKeys(t, "k2").Verify(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, claims) {
+		t.Errorf("got %+v, want %+v", *got, claims)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeys(t, "k1")
+	token, err := keys.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"unknown kid", resign(t, token, header{Algorithm: "HS256", Type: "JWT", KeyID: "k3"}, testKey1), now, ErrUnknownKey},
+		{"other key", resign(t, token, header{Algorithm: "HS256", Type: "JWT", KeyID: "k2"}, testKey1), now, ErrInvalidToken},
+		{"alg none", resign(t, token, header{Algorithm: "none", Type: "JWT", KeyID: "k1"}, testKey1), now, ErrInvalidToken},
+		{"alg HS512", resign(t, token, header{Algorithm: "HS512", Type: "JWT", KeyID: "k1"}, testKey1), now, ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + encoding.EncodeToString(bytes.Repeat([]byte{0}, 32)), now, ErrInvalidToken},
+		{"tampered claims", parts[0] + "." + encoding.EncodeToString([]byte(`{"sub":1,"exp":9999999999}`)) + "." + parts[2], now, ErrInvalidToken},
+		{"signature not base64url", parts[0] + "." + parts[1] + ".!", now, ErrInvalidToken},
+		{"missing part", parts[0] + "." + parts[1], now, ErrInvalidToken},
+		{"expired", token, now.Add(time.Minute), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := keys.Verify(tt.token, tt.now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if claims != nil {
+				t.Errorf("got claims %+v for a rejected token", claims)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testKey1)
+	keys, err := ParseKeys(" k1:" + encoded + ",, k2:" + base64.StdEncoding.EncodeToString(testKey2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"k1": testKey1, "k2": testKey2}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	for _, spec := range []string{"k1", ":" + encoded, "k1:not base64"} {
+		if _, err := ParseKeys(spec); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	if _, err := NewKeys("k1", map[string][]byte{"k1": testKey1[:31]}); err == nil {
+		t.Error("accepted a 31 byte key")
+	}
+	if _, err := NewKeys("k1", map[string][]byte{"k1": testKey1, "k2": testKey2[:16]}); err == nil {
+		t.Error("accepted a short inactive key")
+	}
+	if _, err := NewKeys("k3", map[string][]byte{"k1": testKey1}); err == nil {
+		t.Error("accepted an active key that isn't configured")
+	}
+}
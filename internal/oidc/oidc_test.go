@@ -0,0 +1,256 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "idkn-test"
+	testRedirect = "http://localhost:8000/v1/oidc/test/callback"
+	testCode     = "the-code"
+)
+
+// stubProvider is a stand-in OpenID provider serving discovery, JWKS and
+// token endpoints. The token endpoint answers with whatever claims is set
+// to, once the code and PKCE verifier check out.
+type stubProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	keyID     string
+	challenge string
+	claims    map[string]any
+
+	// signer and signerID are the key ID tokens are signed with, key and
+	// keyID unless a test swaps them.
+	signer   *rsa.PrivateKey
+	signerID string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &stubProvider{key: key, keyID: "k1", signer: key, signerID: "k1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 sp.URL,
+			"authorization_endpoint": sp.URL + "/authorize",
+			"token_endpoint":         sp.URL + "/token",
+			"jwks_uri":               sp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": sp.keyID,
+				"n":   base64.RawURLEncoding.EncodeToString(sp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(sp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case r.PostForm.Get("grant_type") != "authorization_code",
+			r.PostForm.Get("code") != testCode,
+			r.PostForm.Get("client_id") != testClientID,
+			r.PostForm.Get("redirect_uri") != testRedirect,
+			base64.RawURLEncoding.EncodeToString(sum[:]) != sp.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"id_token":     sp.sign(t, sp.claims),
+		})
+	})
+	sp.Server = httptest.NewServer(mux)
+	t.Cleanup(sp.Close)
+	return sp
+}
+
+func (sp *stubProvider) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": sp.signerID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sp.signer, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (sp *stubProvider) validClaims(nonce string) map[string]any {
+	return map[string]any{
+		"iss":            sp.URL,
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	sp := newStubProvider(t)
+	p, err := NewProvider(context.Background(), Config{Name: "test", Issuer: sp.URL, ClientID: testClientID, RedirectURL: testRedirect}, sp.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(p.AuthCodeURL("s", "n", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != sp.URL+"/authorize" {
+		t.Errorf("endpoint = %q", got)
+	}
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirect,
+		"scope":                 "openid email profile",
+		"state":                 "s",
+		"nonce":                 "n",
+		"code_challenge":        "c",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestNewProviderIssuerMismatch(t *testing.T) {
+	sp := newStubProvider(t)
+	_, err := NewProvider(context.Background(), Config{Name: "test", Issuer: sp.URL + "/other", ClientID: testClientID}, sp.Client())
+	if err == nil {
+		t.Fatal("expected an error for a discovery document from another issuer")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(sp *stubProvider, claims map[string]any)
+		verifier func(verifier string) string
+		wantErr  error
+	}{
+		{name: "valid"},
+		{
+			name:   "audience array",
+			modify: func(_ *stubProvider, c map[string]any) { c["aud"] = []string{"someone-else", testClientID} },
+		},
+		{
+			name:    "wrong nonce",
+			modify:  func(_ *stubProvider, c map[string]any) { c["nonce"] = "replayed" },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong audience",
+			modify:  func(_ *stubProvider, c map[string]any) { c["aud"] = "someone-else" },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong issuer",
+			modify:  func(_ *stubProvider, c map[string]any) { c["iss"] = "https://evil.example.com" },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "expired",
+			modify:  func(_ *stubProvider, c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "bad signature",
+			modify:  func(sp *stubProvider, _ map[string]any) { sp.signer = other },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "unknown key",
+			modify:  func(sp *stubProvider, _ map[string]any) { sp.signerID = "k2"; sp.signer = other },
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:     "wrong verifier",
+			verifier: func(string) string { return "not-the-verifier" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := newStubProvider(t)
+			p, err := NewProvider(context.Background(), Config{Name: "test", Issuer: sp.URL, ClientID: testClientID, RedirectURL: testRedirect}, sp.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, challenge, err := NewPKCE()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce, err := NewState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sp.challenge = challenge
+			sp.claims = sp.validClaims(nonce)
+			if tt.modify != nil {
+				tt.modify(sp, sp.claims)
+			}
+			if tt.verifier != nil {
+				verifier = tt.verifier(verifier)
+			}
+
+			claims, err := p.Exchange(context.Background(), testCode, verifier, nonce)
+			switch {
+			case tt.verifier != nil:
+				if !errors.Is(err, ErrExchange) {
+					t.Fatalf("err = %v, want %v", err, ErrExchange)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case claims.Subject != "subject-1" || claims.Email != "alice@example.com" || !claims.EmailVerified:
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 6238 test vectors.
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+// rfcVectors are the SHA-1 vectors of RFC 6238 appendix B, keeping the last
+// 6 of their 8 digits as a 6 digit code does.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, tt := range rfcVectors {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+
+	// secrets are accepted whatever their case, as apps show them.
+	got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("lower case secret: got %s, %v", got, err)
+	}
+	if _, err = Code("not base32!", 1); err == nil {
+		t.Error("accepted a secret that isn't base32")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range rfcVectors {
+		now := time.Unix(tt.unix, 0)
+		step, ok := Validate(rfcSecret, tt.code, now, 0)
+		if !ok || step != Step(now) {
+			t.Errorf("T=%d: got step %d, %v; want %d, true", tt.unix, step, ok, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 1111111109 and 1111111111 fall in consecutive steps.
+	issued := time.Unix(1111111109, 0)
+	code := "081804"
+	tests := []struct {
+		name string
+		now  time.Time
+		skew int
+		ok   bool
+	}{
+		{"same step", issued, 0, true},
+		{"next step without skew", issued.Add(Period), 0, false},
+		{"next step", issued.Add(Period), 1, true},
+		{"previous step", issued.Add(-Period), 1, true},
+		{"two steps later", issued.Add(2 * Period), 1, false},
+		{"two steps later, skew 2", issued.Add(2 * Period), 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, code, tt.now, tt.skew)
+			if ok != tt.ok {
+				t.Fatalf("got %v, want %v", ok, tt.ok)
+			}
+			// the step matched is the code's, not the current one, so the
+			// caller's replay check sees the code's age.
+			if ok && step != Step(issued) {
+				t.Errorf("got step %d, want %d", step, Step(issued))
+			}
+		})
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	for _, code := range []string{"", "08180", "0818040", "081805", "abcdef", "94287082"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("accepted %q", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "081804", now, 1); ok {
+		t.Error("accepted a code for a secret that isn't base32")
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	// a code stays valid for its whole window. It keeps matching its own
+	// step, which the caller refuses once it accepted it.
+	now := time.Unix(1111111109, 0)
+	first, ok := Validate(rfcSecret, "081804", now, 1)
+	if !ok {
+		t.Fatal("code refused")
+	}
+	again, ok := Validate(rfcSecret, "081804", now.Add(Period), 1)
+	if !ok || again != first {
+		t.Errorf("reused code: got step %d, %v; want %d, true", again, ok, first)
+	}
+}
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS collections (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+name text NOT NULL,
+description text NOT NULL DEFAULT '',
+version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS collections_movies (
+    collection_id bigint NOT NULL REFERENCES collections ON DELETE CASCADE,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    position integer NOT NULL,
+    PRIMARY KEY (collection_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS collections_movies_movie_id_idx ON collections_movies (movie_id);
+
+INSERT INTO permissions (code) VALUES('collection:write');
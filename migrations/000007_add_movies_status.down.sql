@@ -0,0 +1,6 @@
+DELETE FROM permissions WHERE code = 'movie:publish';
+DROP INDEX IF EXISTS movies_status_idx;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_status_check;
+ALTER TABLE movies DROP COLUMN IF EXISTS review_reason;
+ALTER TABLE movies DROP COLUMN IF EXISTS submitted_by;
+ALTER TABLE movies DROP COLUMN IF EXISTS status;
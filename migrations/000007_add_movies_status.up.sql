@@ -0,0 +1,9 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS submitted_by bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS review_reason text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD CONSTRAINT movies_status_check CHECK (status IN ('draft', 'pending_review', 'published', 'archived'));
+ALTER TABLE movies ALTER COLUMN status SET DEFAULT 'draft';
+
+CREATE INDEX IF NOT EXISTS movies_status_idx ON movies (status);
+
+INSERT INTO permissions (code) VALUES('movie:publish');
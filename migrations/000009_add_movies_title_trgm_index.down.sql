@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS movies_title_trgm_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_count;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+key text PRIMARY KEY,
+revoked_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+
+-- the up migration only inserts these codes when missing, keep the ones
+-- granted to users.
+DELETE FROM permissions
+WHERE code IN ('movie:read', 'movie:create')
+AND NOT EXISTS (SELECT 1 FROM users_permissions WHERE users_permissions.permission_id = permissions.id);
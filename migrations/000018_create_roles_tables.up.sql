@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS roles (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+name text UNIQUE NOT NULL,
+description text NOT NULL DEFAULT '',
+version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (code)
+SELECT c FROM unnest(ARRAY['movie:read', 'movie:create']) AS c
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = c);
+
+INSERT INTO roles (name, description) VALUES
+('viewer', 'Browse the published catalogue'),
+('editor', 'Submit movies and curate collections'),
+('admin', 'Publish movies and manage users');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code IN ('movie:read'))
+OR (roles.name = 'editor' AND permissions.code IN ('movie:read', 'movie:create', 'collection:write'))
+OR (roles.name = 'admin' AND permissions.code IN ('movie:read', 'movie:create', 'movie:publish', 'collection:write', 'stats:read', 'users:admin'));
@@ -0,0 +1,3 @@
+INSERT INTO permissions (code) VALUES('movies:read'), ('movies:write');
+ALTER TABLE permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
+ALTER TABLE permissions DROP COLUMN IF EXISTS description;
@@ -0,0 +1,14 @@
+ALTER TABLE permissions ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+-- the first migration seeded codes the application never checked, hand their
+-- grants over to the codes it does check.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT up.user_id, replacement.id
+FROM users_permissions up
+INNER JOIN permissions legacy ON legacy.id = up.permission_id
+INNER JOIN permissions replacement ON replacement.code = CASE legacy.code WHEN 'movies:read' THEN 'movie:read' ELSE 'movie:create' END
+WHERE legacy.code IN ('movies:read', 'movies:write')
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions WHERE code IN ('movies:read', 'movies:write');
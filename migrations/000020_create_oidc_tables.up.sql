@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS oidc_states (
+state_hash bytea PRIMARY KEY,
+provider text NOT NULL,
+nonce text NOT NULL,
+verifier text NOT NULL,
+expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+provider text NOT NULL,
+subject text NOT NULL,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+PRIMARY KEY (provider, subject)
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS tokens_expiry_idx;
+DROP INDEX IF EXISTS users_never_activated_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deletion_warned_at;
+ALTER TABLE users DROP COLUMN IF EXISTS activated_at;
@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_warned_at timestamp(0) with time zone;
+UPDATE users SET activated_at = created_at WHERE activated AND activated_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS users_never_activated_idx ON users (created_at) WHERE activated_at IS NULL;
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);